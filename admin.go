@@ -0,0 +1,53 @@
+package httpagain
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// AdminHandler returns a handler that starts a graceful restart on POST /restart and a graceful shutdown
+// on POST /shutdown, for platforms where sending signals to the process is awkward.
+// Requests must have the header "Authorization: Bearer <token>", if token is empty all requests are rejected.
+// It responds with 202 without waiting for the restart or shutdown to finish.
+// Serve it only on an internal listener, e.g. a separate address given to ListenAndServeSpecs.
+// Use http.StripPrefix to mount it under a path prefix.
+func (s *Server) AdminHandler(token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !validToken(r, token) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		var action func()
+		switch r.URL.Path {
+		case "/restart":
+			action = s.Restart
+		case "/shutdown":
+			action = s.Stop
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		s.logger().Printf("%s requested by %s", strings.TrimPrefix(r.URL.Path, "/"), r.RemoteAddr)
+		action()
+		w.WriteHeader(http.StatusAccepted)
+	})
+}
+
+// validToken tells whether r is authorized with token. The comparison takes constant time.
+func validToken(r *http.Request, token string) bool {
+	auth := r.Header.Get("Authorization")
+	if token == "" || !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(token)) == 1
+}
+
+// AdminHandler returns an admin handler for the server started with ListenAndServe.
+func AdminHandler(token string) http.Handler { return defaultServer.AdminHandler(token) }
@@ -0,0 +1,26 @@
+package httpagain
+
+import "time"
+
+// Clock tells the time to the accept loops and the drain phases. The default one uses the time package.
+// Tests can replace it with a fake that is advanced manually, to check that grace periods and
+// timeouts expire at the right time without sleeping. Deadlines of connections always use real time.
+type Clock interface {
+	// Now returns the current time, like time.Now.
+	Now() time.Time
+
+	// After returns a channel that receives the current time after d, like time.After.
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+func (s *Server) clock() Clock {
+	if s.Clock != nil {
+		return s.Clock
+	}
+	return realClock{}
+}
@@ -1,33 +1,360 @@
 package httpagain
 
 import (
+	"crypto/tls"
+	"math"
 	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // timeoutConn wraps a net.Conn, and sets a deadline for every read and write operation.
+// It also keeps track of open connections of the server.
 type timeoutConn struct {
 	net.Conn
 	readTimeout  time.Duration
 	writeTimeout time.Duration
+	idleTimeout  time.Duration
+	idleTimer    *time.Timer
+	server       *Server
+
+	// drainWriteTimeout replaces writeTimeout after stopping is closed.
+	drainWriteTimeout time.Duration
+	stopping          <-chan struct{}
+
+	// srvIdle tells that http.Server limits the time a keep-alive connection waits for the next request.
+	// readTimeout is not applied while the connection is idle then.
+	srvIdle bool
+	idle    int32 // accessed atomically
+	http2   int32 // set when HTTP/2 is negotiated, accessed atomically
+
+	// fresh is set until the connection leaves http.StateNew, accessed atomically.
+	// bytesRead counts the bytes read from the connection, accessed atomically.
+	accepted  time.Time
+	fresh     int32
+	bytesRead int64
+
+	deadlineMu    sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	// headerDeadline limits the total time to read the request headers. It is zero while a handler runs.
+	headerTimeout  time.Duration
+	headerDeadline time.Time // guarded by deadlineMu
+
+	// firstByteDeadline drops a client that sends nothing in readTimeout after it connects,
+	// even if it is not read yet. It is zero after the first byte is read.
+	firstByteDeadline time.Time // guarded by deadlineMu
+	awaitingFirstByte bool      // accessed only by Read
+
+	// requestDone stops counting the active request of the connection.
+	// It is accessed only by the goroutine serving the connection.
+	requestDone func()
+	hijacked    bool  // guarded by server.mu
+	requests    int64 // accessed atomically
+
+	sem       chan struct{}
+	closeOnce sync.Once
+}
+
+// newConn wraps c and counts it as an open connection until it is closed.
+// sem is the slot acquired for c in accept loop, it is released on close.
+// Timeouts set in srv replace the corresponding connection timeouts of the server.
+func (s *Server) newConn(c net.Conn, sem chan struct{}, srv *http.Server) *timeoutConn {
+	tc := &timeoutConn{
+		Conn:         c,
+		readTimeout:  s.TCPReadTimeout,
+		writeTimeout: s.TCPWriteTimeout,
+		idleTimeout:  s.IdleTimeout,
+		srvIdle:      srv.IdleTimeout > 0,
+		server:       s,
+		sem:          sem,
+
+		drainWriteTimeout: s.DrainWriteTimeout,
+		stopping:          s.Stopping(),
+		headerTimeout:     s.HeaderReadTimeout,
+		accepted:          s.clock().Now(),
+		fresh:             1,
+	}
+	if srv.ReadTimeout > 0 || srv.ReadHeaderTimeout > 0 {
+		tc.readTimeout = 0
+	}
+	if tc.readTimeout > 0 {
+		tc.firstByteDeadline = time.Now().Add(tc.readTimeout)
+		tc.awaitingFirstByte = true
+		c.SetReadDeadline(tc.firstByteDeadline)
+	}
+	tc.armHeaderDeadline()
+	if srv.WriteTimeout > 0 {
+		tc.writeTimeout = 0
+	}
+	atomic.AddInt64(&s.activeConns, 1)
+	s.mu.Lock()
+	if s.conns == nil {
+		s.conns = make(map[*timeoutConn]struct{})
+	}
+	s.conns[tc] = struct{}{}
+	s.mu.Unlock()
+	return tc
+}
+
+// connOf returns the timeoutConn wrapped by c.
+func connOf(c net.Conn) *timeoutConn {
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	if pc, ok := c.(*proxyConn); ok {
+		c = pc.Conn
+	}
+	tc, _ := c.(*timeoutConn)
+	return tc
+}
+
+// setState is called by http.Server when the state of the connection changes.
+// conn is the connection served by http.Server, which wraps c.
+// The connection is closed if it stays idle, i.e. without an active request, longer than idleTimeout.
+func (c *timeoutConn) setState(conn net.Conn, state http.ConnState) {
+	if state == http.StateHijacked {
+		c.hijack()
+	}
+	if state == http.StateActive {
+		if tc, ok := conn.(*tls.Conn); ok && tc.ConnectionState().NegotiatedProtocol == "h2" {
+			atomic.StoreInt32(&c.http2, 1)
+		}
+	}
+	if state != http.StateNew {
+		atomic.StoreInt32(&c.fresh, 0)
+	}
+	if state == http.StateIdle {
+		atomic.StoreInt32(&c.idle, 1)
+	} else {
+		atomic.StoreInt32(&c.idle, 0)
+	}
+	if c.idleTimeout <= 0 {
+		return
+	}
+	switch state {
+	case http.StateNew, http.StateIdle:
+		if c.idleTimer == nil {
+			c.idleTimer = time.AfterFunc(c.idleTimeout, func() { c.Close() })
+		} else {
+			c.idleTimer.Reset(c.idleTimeout)
+		}
+	case http.StateActive, http.StateHijacked, http.StateClosed:
+		if c.idleTimer != nil {
+			c.idleTimer.Stop()
+		}
+	}
+}
+
+// hijack moves the connection from active requests to hijacked connections.
+// hijack is called from Hijack in the handler, so the handler can still be running.
+// The handler owns the connection from now on, so the connection timeouts do not apply anymore.
+func (c *timeoutConn) hijack() {
+	c.server.mu.Lock()
+	c.hijacked = true
+	c.server.mu.Unlock()
+	c.server.hijackWG.Add(1)
+	c.readTimeout, c.writeTimeout, c.drainWriteTimeout = 0, 0, 0
+	if c.requestDone != nil {
+		c.requestDone()
+	}
 }
 
 func (c *timeoutConn) Read(b []byte) (int, error) {
-	if c.readTimeout > 0 {
-		err := c.Conn.SetReadDeadline(time.Now().Add(c.readTimeout))
+	if c.readTimeout > 0 && !(c.srvIdle && atomic.LoadInt32(&c.idle) == 1) {
+		c.deadlineMu.Lock()
+		err := c.Conn.SetReadDeadline(c.readLimit(earliest(time.Now().Add(c.readTimeout), c.readDeadline)))
+		c.deadlineMu.Unlock()
 		if err != nil {
 			return 0, err
 		}
 	}
-	return c.Conn.Read(b)
+	n, err := c.Conn.Read(b)
+	if n > 0 && atomic.LoadInt32(&c.idle) == 1 && atomic.LoadInt32(&c.http2) == 0 {
+		// The next request on a keep-alive connection has started to arrive. HTTP/2 connections
+		// are not limited, frames read while they are idle, e.g. pings, are not request headers.
+		c.armHeaderDeadline()
+	}
+	if n > 0 && c.awaitingFirstByte {
+		c.awaitingFirstByte = false
+		c.deadlineMu.Lock()
+		c.firstByteDeadline = time.Time{}
+		c.deadlineMu.Unlock()
+	}
+	atomic.AddInt64(&c.bytesRead, int64(n))
+	atomic.AddInt64(&c.server.bytesRead, int64(n))
+	return n, err
 }
 
 func (c *timeoutConn) Write(b []byte) (int, error) {
-	if c.writeTimeout > 0 {
-		err := c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	timeout := c.writeTimeout
+	if c.drainWriteTimeout > 0 && c.draining() {
+		timeout = c.drainWriteTimeout
+	}
+	if timeout > 0 {
+		c.deadlineMu.Lock()
+		err := c.Conn.SetWriteDeadline(earliest(time.Now().Add(timeout), c.writeDeadline))
+		c.deadlineMu.Unlock()
 		if err != nil {
 			return 0, err
 		}
 	}
-	return c.Conn.Write(b)
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.server.bytesWritten, int64(n))
+	if err != nil && c.draining() {
+		// The response cannot be finished, e.g. DrainWriteTimeout is reached. Without a reset,
+		// a response delimited by closing the connection would look complete to the client.
+		c.reset()
+	}
+	return n, err
+}
+
+// draining tells whether the server has started shutting down.
+func (c *timeoutConn) draining() bool {
+	select {
+	case <-c.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// Deadlines set by http.Server are remembered so that the per operation deadlines do not extend them.
+// Otherwise, http.Server cannot interrupt a pending read by setting a deadline in the past.
+
+func (c *timeoutConn) SetDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	c.readDeadline, c.writeDeadline = t, t
+	if err := c.Conn.SetReadDeadline(c.readLimit(t)); err != nil {
+		return err
+	}
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *timeoutConn) SetReadDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(c.readLimit(t))
+}
+
+// armHeaderDeadline starts the time limit for reading the request headers, unless it is already running.
+// Unlike the per read timeout, a client sending the headers byte by byte cannot extend it.
+func (c *timeoutConn) armHeaderDeadline() {
+	if c.headerTimeout <= 0 {
+		return
+	}
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	if !c.headerDeadline.IsZero() {
+		return
+	}
+	c.headerDeadline = time.Now().Add(c.headerTimeout)
+	c.Conn.SetReadDeadline(c.readLimit(c.readDeadline))
+}
+
+// headerRead stops the time limit for reading the request headers. It is called when the handler starts.
+func (c *timeoutConn) headerRead() {
+	if c.headerTimeout <= 0 {
+		return
+	}
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	if c.headerDeadline.IsZero() {
+		return
+	}
+	c.headerDeadline = time.Time{}
+	c.Conn.SetReadDeadline(c.readLimit(c.readDeadline))
+}
+
+// readLimit returns the read deadline t limited by the header and first byte deadlines.
+// deadlineMu must be held.
+func (c *timeoutConn) readLimit(t time.Time) time.Time {
+	return earliest(earliest(t, c.headerDeadline), c.firstByteDeadline)
+}
+
+func (c *timeoutConn) SetWriteDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	c.writeDeadline = t
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// earliest returns the earlier of t and deadline. Zero means no deadline for both.
+func earliest(t, deadline time.Time) time.Time {
+	if t.IsZero() {
+		return deadline
+	}
+	if !deadline.IsZero() && deadline.Before(t) {
+		return deadline
+	}
+	return t
+}
+
+// reset closes the connection with a TCP RST instead of a FIN, so the client fails the request and can retry it.
+// Data not sent yet is discarded.
+func (c *timeoutConn) reset() error {
+	if lc, ok := c.Conn.(interface{ SetLinger(sec int) error }); ok {
+		lc.SetLinger(0)
+	}
+	return c.Close()
+}
+
+func (c *timeoutConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		c.server.mu.Lock()
+		delete(c.server.conns, c)
+		hijacked := c.hijacked
+		c.server.mu.Unlock()
+		atomic.AddInt64(&c.server.activeConns, -1)
+		if hijacked {
+			c.server.hijackWG.Done()
+		}
+		c.server.recordRequestsPerConn(atomic.LoadInt64(&c.requests))
+		if c.sem != nil {
+			<-c.sem
+		}
+	})
+	return err
+}
+
+// requestsPerConnBounds are the upper bounds of the buckets of RequestsPerConnHistogram.
+// Connections serving more requests than the last bound are counted in an extra bucket.
+var requestsPerConnBounds = [...]int64{0, 1, 2, 4, 8, 16, 32, 64, 128, 256, 512, 1024}
+
+// Bucket is a bucket of a histogram. It counts the values that are at most Max
+// and greater than the Max of the previous bucket.
+type Bucket struct {
+	Max   int64
+	Count int64
+}
+
+// recordRequestsPerConn counts a closed connection that served n requests.
+func (s *Server) recordRequestsPerConn(n int64) {
+	i := 0
+	for i < len(requestsPerConnBounds) && n > requestsPerConnBounds[i] {
+		i++
+	}
+	atomic.AddInt64(&s.reqsPerConn[i], 1)
+	atomic.AddInt64(&s.reqsOfConns, n)
+}
+
+// RequestsPerConnHistogram returns the number of closed connections by the number of requests they served.
+// It helps to see whether clients reuse keep-alive connections. Each HTTP/2 stream is counted as a request.
+// The Max of the last bucket is math.MaxInt64.
+func (s *Server) RequestsPerConnHistogram() []Bucket {
+	buckets := make([]Bucket, len(s.reqsPerConn))
+	for i := range buckets {
+		buckets[i].Max = math.MaxInt64
+		if i < len(requestsPerConnBounds) {
+			buckets[i].Max = requestsPerConnBounds[i]
+		}
+		buckets[i].Count = atomic.LoadInt64(&s.reqsPerConn[i])
+	}
+	return buckets
 }
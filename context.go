@@ -0,0 +1,91 @@
+package httpagain
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+type serverContextKey struct{}
+
+type connContextKey struct{}
+
+// ShutdownNotify returns a channel that is closed when the server handling the request starts shutting down.
+// ctx must be the context of a request served by httpagain, otherwise nil is returned.
+func ShutdownNotify(ctx context.Context) <-chan struct{} {
+	s, ok := ctx.Value(serverContextKey{}).(*Server)
+	if !ok {
+		return nil
+	}
+	return s.Stopping()
+}
+
+// Interruptible makes the requests handled by h not delay draining, e.g. for long polling or server-sent events.
+// The request context is canceled when the server starts shutting down, so h should return when it is done.
+// Other requests are still allowed to finish in RequestGracePeriod.
+func Interruptible(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stopping := ShutdownNotify(r.Context())
+		if stopping == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		go func() {
+			select {
+			case <-stopping:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// ListenAndServeContext is like ListenAndServe but also starts a graceful shutdown when ctx is done.
+func (s *Server) ListenAndServeContext(ctx context.Context, addr string, srv *http.Server) error {
+	go s.stopOnDone(ctx)
+	return s.ListenAndServe(addr, srv)
+}
+
+// stopOnDone calls Stop when ctx is done.
+func (s *Server) stopOnDone(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+		s.Stop()
+	case <-s.Stopping():
+	}
+}
+
+// withServerContext makes the server available to the request contexts of srv.
+func (s *Server) withServerContext(srv *http.Server) {
+	base := srv.BaseContext
+	srv.BaseContext = func(l net.Listener) context.Context {
+		ctx := context.Background()
+		if base != nil {
+			ctx = base(l)
+		}
+		return context.WithValue(ctx, serverContextKey{}, s)
+	}
+}
+
+// withConnContext makes the connection available to the request contexts of srv.
+func (s *Server) withConnContext(srv *http.Server) {
+	connContext := srv.ConnContext
+	srv.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		if connContext != nil {
+			ctx = connContext(ctx, c)
+		}
+		return context.WithValue(ctx, connContextKey{}, c)
+	}
+}
+
+// connFromContext returns the connection of the request with context ctx.
+func connFromContext(ctx context.Context) *timeoutConn {
+	c, _ := ctx.Value(connContextKey{}).(net.Conn)
+	if c == nil {
+		return nil
+	}
+	return connOf(c)
+}
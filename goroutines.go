@@ -0,0 +1,157 @@
+package httpagain
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// callSites counts calls of Begin and End by their call sites when DebugGoroutines is set.
+type callSites struct {
+	begin map[string]int
+	end   map[string]int
+}
+
+func (s *Server) begin(skip int) {
+	if s.DebugGoroutines {
+		s.recordCall(false, skip+1)
+	}
+	atomic.AddInt64(&s.goroutines, 1)
+	s.goroutineWG.Add(1)
+}
+
+func (s *Server) end(skip int) {
+	if s.DebugGoroutines {
+		s.recordCall(true, skip+1)
+	}
+	atomic.AddInt64(&s.goroutines, -1)
+	s.goroutineWG.Done()
+}
+
+// recordCall counts the call site skip frames above its caller.
+func (s *Server) recordCall(end bool, skip int) {
+	site := "unknown"
+	if _, file, line, ok := runtime.Caller(skip + 1); ok {
+		site = fmt.Sprintf("%s:%d", file, line)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.callSites.begin == nil {
+		s.callSites.begin = make(map[string]int)
+		s.callSites.end = make(map[string]int)
+	}
+	if end {
+		s.callSites.end[site]++
+	} else {
+		s.callSites.begin[site]++
+	}
+}
+
+// logCallSites logs the call sites of Begin and End, so an End call missing for a Begin call can be found.
+func (s *Server) logCallSites() {
+	if !s.DebugGoroutines {
+		return
+	}
+	s.mu.Lock()
+	var lines []string
+	for _, site := range sortedSites(s.callSites.begin) {
+		lines = append(lines, fmt.Sprintf("Begin called %d times at %s", s.callSites.begin[site], site))
+	}
+	for _, site := range sortedSites(s.callSites.end) {
+		lines = append(lines, fmt.Sprintf("End called %d times at %s", s.callSites.end[site], site))
+	}
+	s.mu.Unlock()
+	for _, line := range lines {
+		s.logger().Printf("%s", line)
+	}
+}
+
+// dumpGoroutines writes the stacks of all goroutines if DumpGoroutinesOnSlowShutdown is set.
+func (s *Server) dumpGoroutines() {
+	if !s.DumpGoroutinesOnSlowShutdown {
+		return
+	}
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	if s.GoroutineDumpFile == "" {
+		s.logger().Printf("goroutine dump:\n%s", buf)
+		return
+	}
+	f, err := os.OpenFile(s.GoroutineDumpFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		s.logger().Printf("cannot write goroutine dump: %s", err)
+		return
+	}
+	defer f.Close()
+	fmt.Fprintf(f, "goroutine dump of pid %d at %s:\n%s\n", os.Getpid(), time.Now().Format(time.RFC3339Nano), buf)
+	s.logger().Printf("goroutine dump is written to %s", s.GoroutineDumpFile)
+}
+
+func sortedSites(m map[string]int) []string {
+	sites := make([]string, 0, len(m))
+	for site := range m {
+		sites = append(sites, site)
+	}
+	sort.Strings(sites)
+	return sites
+}
+
+// Token tracks a goroutine like a Begin call. Call Done when the goroutine finishes.
+type Token struct {
+	s    *Server
+	done int32 // accessed atomically
+}
+
+// Track must be called before spawning new goroutine from request handlers, like Begin.
+// Unlike End, calling Done of the returned token more than once is a no-op.
+func (s *Server) Track() *Token { return s.track(1) }
+
+func (s *Server) track(skip int) *Token {
+	s.begin(skip + 1)
+	return &Token{s: s}
+}
+
+// Done must be called at the end of the goroutine, like End.
+// It is safe to call Done more than once.
+func (t *Token) Done() { t.finish(1) }
+
+func (t *Token) finish(skip int) {
+	if !atomic.CompareAndSwapInt32(&t.done, 0, 1) {
+		return
+	}
+	t.s.end(skip + 1)
+}
+
+// BeginContext must be called before spawning new goroutine from request handlers, like Begin.
+// The returned context is canceled when the server starts shutting down, so the goroutine can cut its work short
+// instead of holding the drain for GoroutineGracePeriod. Call the returned function when the goroutine finishes,
+// like End. It is safe to call it more than once.
+func (s *Server) BeginContext() (context.Context, func()) { return s.beginContext(1) }
+
+func (s *Server) beginContext(skip int) (context.Context, func()) {
+	t := s.track(skip + 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopping := s.Stopping()
+	go func() {
+		select {
+		case <-stopping:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		cancel()
+		t.finish(1)
+	}
+}
@@ -0,0 +1,52 @@
+package httpagain
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTokenDoneTwice(t *testing.T) {
+	s := newTestServer()
+	tok := s.Track()
+	if n := s.ActiveGoroutines(); n != 1 {
+		t.Fatalf("ActiveGoroutines() = %d after Track, want 1", n)
+	}
+	tok.Done()
+	tok.Done()
+	if n := s.ActiveGoroutines(); n != 0 {
+		t.Fatalf("ActiveGoroutines() = %d after Done, want 0", n)
+	}
+
+	// The second Done must not have taken the count of another goroutine.
+	other := s.Track()
+	tok.Done()
+	if n := s.ActiveGoroutines(); n != 1 {
+		t.Fatalf("ActiveGoroutines() = %d, want 1", n)
+	}
+	other.Done()
+	if n := s.ActiveGoroutines(); n != 0 {
+		t.Fatalf("ActiveGoroutines() = %d, want 0", n)
+	}
+}
+
+func TestBeginContextCallSites(t *testing.T) {
+	s := newTestServer()
+	s.DebugGoroutines = true
+	_, end := s.BeginContext()
+	end()
+	tok := s.Track()
+	tok.Done()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sites := range []map[string]int{s.callSites.begin, s.callSites.end} {
+		for site := range sites {
+			if !strings.Contains(site, "goroutines_test.go:") {
+				t.Errorf("call site is %s, want one in goroutines_test.go", site)
+			}
+		}
+		if len(sites) != 2 {
+			t.Errorf("call sites = %v, want 2 of them", sites)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package httpagain
+
+import "time"
+
+// Handoff records the timing of passing the listeners to another process on restart.
+// The other process starts accepting before it tells this process to stop,
+// so the listeners are accepted on by both processes for a while and no connection is lost.
+type Handoff struct {
+	// Ready is when this process received the signal of the other process telling that it is accepting
+	// connections. The other process started accepting shortly before.
+	Ready time.Time
+
+	// StoppedAccepting is when this process stopped accepting connections.
+	StoppedAccepting time.Time
+}
+
+// Overlap returns how long both processes accepted connections at least, since the other process started
+// accepting before Ready. A long overlap shows that this process is slow to stop accepting.
+// Connections are not lost in the handoff, unless ReusePort is set.
+func (h Handoff) Overlap() time.Duration { return h.StoppedAccepting.Sub(h.Ready) }
+
+// LastHandoff returns the timing of the last handoff of the listeners to another process.
+// It is the zero value if the listeners are not handed off yet.
+// Since the process is re-executed after draining, read it in a shutdown hook or in OnPhase.
+func (s *Server) LastHandoff() Handoff {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.handoff
+}
+
+// recordHandoff records a handoff and warns if connections may be lost in it.
+func (s *Server) recordHandoff(h Handoff) {
+	s.mu.Lock()
+	s.handoff = h
+	s.mu.Unlock()
+	s.logger().Printf("listeners were accepted on by both processes for at least %s during restart", h.Overlap())
+	if s.ReusePort {
+		s.logger().Printf("warning: connections waiting in the accept queues of the closed sockets are dropped with ReusePort")
+	}
+}
@@ -0,0 +1,32 @@
+package httpagain
+
+import "net/http"
+
+// IsShuttingDown reports whether the server has started shutting down or restarting.
+func (s *Server) IsShuttingDown() bool {
+	select {
+	case <-s.Stopping():
+		return true
+	default:
+		return false
+	}
+}
+
+// HealthHandler returns a handler for load balancer health checks.
+// It responds with 200 while the server is serving and with 503 once draining starts,
+// so the load balancer can stop sending new traffic while active requests finish.
+func (s *Server) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.IsShuttingDown() {
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+}
+
+// IsShuttingDown reports whether the server started with ListenAndServe has started shutting down or restarting.
+func IsShuttingDown() bool { return defaultServer.IsShuttingDown() }
+
+// HealthHandler returns a health check handler for the server started with ListenAndServe.
+func HealthHandler() http.Handler { return defaultServer.HealthHandler() }
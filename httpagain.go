@@ -4,59 +4,123 @@
 // httpagain uses double-fork strategy as default to keep same PID after restart.
 // This plays nicely with process managers such as upstart, supervisord, etc.
 // Send SIGTERM for graceful shutdown.
+// On Windows, restart is not supported but servers are still shut down gracefully
+// on interrupt, Stop or context cancellation.
 package httpagain
 
 import (
-	"fmt"
+	"context"
 	"log"
 	"net"
 	"net/http"
-	"sync"
-	"syscall"
 	"time"
-
-	"github.com/rcrowley/goagain"
 )
 
+// Package-level settings are used by the package-level functions.
+// They are also the defaults for servers created with NewServer.
 var (
 	// RequestGracePeriod is the duration to wait for active requests
-	// to finish before restarting/shutting down the server. Set 0 to wait indefinitely.
+	// to finish before restarting/shutting down the server. Set WaitForever to wait indefinitely.
 	RequestGracePeriod = 30 * time.Second
 
 	// GoroutineGracePeriod is the duration to wait for running goroutines (tracked with Begin() and End() calls)
-	// to finish before restarting/shutting down the server. Set 0 to wait indefinitely.
+	// to finish before restarting/shutting down the server. Set WaitForever to wait indefinitely.
 	GoroutineGracePeriod = 30 * time.Second
 
 	// TCPReadTimeout for read operations on connections. Set 0 to disable.
+	// See Server.TCPReadTimeout for how it is combined with the timeouts of http.Server.
 	TCPReadTimeout = 30 * time.Second
 
 	// TCPWriteTimeout for write operations on connections. Set 0 to disable.
+	// It is not applied if srv.WriteTimeout is set.
 	TCPWriteTimeout = 30 * time.Second
 
 	// Shutdown channel will be closed when a signal is received.
+	// It is replaced with a new channel when the server is started again after it is stopped,
+	// so read it after ListenAndServe is called, or prefer Stopping of a Server.
 	Shutdown = make(chan struct{})
 )
 
-const breakAcceptInterval = 100 * time.Millisecond
+// WaitForever can be set to a grace period to wait indefinitely.
+const WaitForever time.Duration = -1
+
+// ZeroWaitsForever makes a grace period of 0 wait indefinitely, like WaitForever.
+// It keeps the behavior of older versions, where 0 was the way to wait indefinitely.
+// Set it to false to make 0 mean not waiting at all. It will be false by default in a future version,
+// so set grace periods that should wait indefinitely to WaitForever.
+var ZeroWaitsForever = true
 
-var goroutineWG sync.WaitGroup
+// defaultServer is used by the package-level functions.
+var defaultServer = newDefaultServer()
 
-func init() {
-	// Use double-fork strategy from goagain package.
-	// After restart pid does not changes.
-	// This plays nicely with process managers such as upstart, supervisord, etc.
-	goagain.Strategy = goagain.Double
+func newDefaultServer() *Server {
+	s := NewServer()
+	s.stopping = Shutdown
+	return s
+}
 
-	log.SetFlags(log.Lmicroseconds | log.Lshortfile)
-	log.SetPrefix(fmt.Sprintf("pid:%d ", syscall.Getpid()))
+// loadDefaultServer copies package-level settings into the default server.
+// HijackGracePeriod follows RequestGracePeriod, as it does for a server created with NewServer.
+func loadDefaultServer() *Server {
+	defaultServer.RequestGracePeriod = RequestGracePeriod
+	defaultServer.HijackGracePeriod = RequestGracePeriod
+	defaultServer.GoroutineGracePeriod = GoroutineGracePeriod
+	defaultServer.TCPReadTimeout = TCPReadTimeout
+	defaultServer.TCPWriteTimeout = TCPWriteTimeout
+	return defaultServer
 }
 
+// Stop starts a graceful shutdown of the server started with ListenAndServe.
+// It is safe to call Stop more than once.
+func Stop() { defaultServer.Stop() }
+
+// Done returns a channel that will be closed when the server started with ListenAndServe finishes draining.
+func Done() <-chan struct{} { return defaultServer.Done() }
+
+// RegisterOnShutdown registers a function to call when the server started with ListenAndServe starts shutting down.
+// Functions are called on both shutdown and restart.
+func RegisterOnShutdown(f func()) { defaultServer.RegisterOnShutdown(f) }
+
+// ActiveConnections returns the number of open connections of the server started with ListenAndServe.
+func ActiveConnections() int { return defaultServer.ActiveConnections() }
+
+// ActiveRequests returns the number of requests being handled by the server started with ListenAndServe.
+func ActiveRequests() int { return defaultServer.ActiveRequests() }
+
+// RequestsPerConnHistogram returns the number of closed connections of the server started with ListenAndServe
+// by the number of requests they served.
+func RequestsPerConnHistogram() []Bucket { return defaultServer.RequestsPerConnHistogram() }
+
+// LastDrainDuration returns how long the last drain of the server started with ListenAndServe took.
+func LastDrainDuration() time.Duration { return defaultServer.LastDrainDuration() }
+
+// ActiveGoroutines returns the number of goroutines tracked with Begin and End that have not ended yet.
+func ActiveGoroutines() int { return defaultServer.ActiveGoroutines() }
+
+// RequestsByProtocol returns the number of requests handled by the server started with ListenAndServe by their protocol.
+func RequestsByProtocol() map[string]int64 { return defaultServer.RequestsByProtocol() }
+
+// BytesRead returns the number of bytes read from the connections of the server started with ListenAndServe.
+func BytesRead() int64 { return defaultServer.BytesRead() }
+
+// BytesWritten returns the number of bytes written to the connections of the server started with ListenAndServe.
+func BytesWritten() int64 { return defaultServer.BytesWritten() }
+
 // Begin must be called before spawning new goroutine from request handlers.
-func Begin() { goroutineWG.Add(1) }
+func Begin() { defaultServer.begin(1) }
 
 // End must be called at the end of goroutines spawned from request handlers.
 // It is recommended to call End() at the beginning of a goroutine with a defer statement.
-func End() { goroutineWG.Done() }
+func End() { defaultServer.end(1) }
+
+// Track must be called before spawning new goroutine from request handlers, like Begin.
+// Unlike End, calling Done of the returned token more than once is a no-op.
+func Track() *Token { return defaultServer.track(1) }
+
+// BeginContext must be called before spawning new goroutine from request handlers, like Begin.
+// The returned context is canceled when the server starts shutting down.
+// Call the returned function when the goroutine finishes, like End.
+func BeginContext() (context.Context, func()) { return defaultServer.beginContext(1) }
 
 // ListenAndServe is similar to http.ListenAndServe.
 // It listens on the TCP network address addr then calls srv.Serve to handle requests on incoming connections.
@@ -64,132 +128,110 @@ func End() { goroutineWG.Done() }
 // If srv is blank, a server with handler http.DefaultServeMux is used.
 // ListenAndServe exits fatally if there is an error.
 func ListenAndServe(addr string, srv *http.Server) {
-	// Set default values.
-	if addr == "" {
-		addr = ":http"
-	}
-	if srv == nil {
-		srv = &http.Server{Addr: addr, Handler: http.DefaultServeMux}
+	if err := ListenAndServeE(addr, srv); err != nil {
+		log.Fatalln(err)
 	}
+}
 
-	var acceptWG, requestWG sync.WaitGroup
-
-	// Wrap original request handler to track active requests.
-	var srvCopy = *srv
-	srv = &srvCopy
-	srv.Handler = wrapHandler(srv.Handler, &requestWG)
-
-	// Inherit a net.Listener from our parent process or listen anew.
-	acceptWG.Add(1)
-	l, err := goagain.Listener()
-	if err != nil {
-		l, err = net.Listen("tcp", addr)
-		if err != nil {
-			log.Fatalln(err)
-		}
-
-		log.Println("listening on", l.Addr())
-		go acceptLoop(l, srv, &acceptWG, &requestWG)
-	} else {
-		log.Println("resuming listening on", l.Addr())
-		go acceptLoop(l, srv, &acceptWG, &requestWG)
-
-		// If this is the child, send the parent SIGUSR2.  If this is the
-		// parent, send the child SIGQUIT.
-		if err = goagain.Kill(); err != nil {
-			log.Fatalln(err)
-		}
-	}
+// ListenAndServeE is like ListenAndServe but returns the error to the caller
+// instead of exiting the process.
+func ListenAndServeE(addr string, srv *http.Server) error {
+	return loadDefaultServer().ListenAndServe(addr, srv)
+}
 
-	// Block the main goroutine awaiting signals.
-	sig, err := goagain.Wait(l)
-	if err != nil {
+// ListenAndServeHandler is like ListenAndServe but serves h without touching http.DefaultServeMux.
+// ListenAndServeHandler exits fatally if there is an error.
+func ListenAndServeHandler(addr string, h http.Handler) {
+	if err := ListenAndServeHandlerE(addr, h); err != nil {
 		log.Fatalln(err)
 	}
+}
+
+// ListenAndServeHandlerE is like ListenAndServeHandler but returns the error to the caller
+// instead of exiting the process.
+func ListenAndServeHandlerE(addr string, h http.Handler) error {
+	return loadDefaultServer().ListenAndServeHandler(addr, h)
+}
 
-	// Signal the goroutine to stop accepting connections and wait for acceptLoop() to finish.
-	// This does not take more than breakAcceptInterval.
-	close(Shutdown)
-
-	var allDoneWG sync.WaitGroup
-	allDoneWG.Add(3)
-	go timeoutWaitGroup(&allDoneWG, &acceptWG, 0, "")
-	go timeoutWaitGroup(&allDoneWG, &requestWG, RequestGracePeriod, "some requests did not finish in allowed period, they will be killed")
-	go timeoutWaitGroup(&allDoneWG, &goroutineWG, GoroutineGracePeriod, "some goroutines did not finish in allowed period, they will be killed")
-	allDoneWG.Wait()
-
-	// If we received SIGUSR2, re-exec the parent process.
-	if goagain.SIGUSR2 == sig {
-		if err := goagain.Exec(l); err != nil {
-			log.Fatalln(err)
-		}
+// ListenAndServeMulti is similar to ListenAndServe but listens on all TCP network addresses in addrs.
+// ListenAndServeMulti exits fatally if there is an error.
+func ListenAndServeMulti(addrs []string, srv *http.Server) {
+	if err := ListenAndServeMultiE(addrs, srv); err != nil {
+		log.Fatalln(err)
 	}
 }
 
-func timeoutWaitGroup(allDoneWG, wg *sync.WaitGroup, timeout time.Duration, timeoutMsg string) {
-	doneWG := make(chan struct{})
-	go func() {
-		wg.Wait()
-		close(doneWG)
-	}()
-	var timeoutChan <-chan time.Time
-	if timeout > 0 {
-		timeoutChan = time.After(timeout)
+// ListenAndServeMultiE is like ListenAndServeMulti but returns the error to the caller
+// instead of exiting the process.
+func ListenAndServeMultiE(addrs []string, srv *http.Server) error {
+	return loadDefaultServer().ListenAndServeMulti(addrs, srv)
+}
+
+// ListenAndServeSpecs is similar to ListenAndServeMulti but listens on addresses of different networks.
+// ListenAndServeSpecs exits fatally if there is an error.
+func ListenAndServeSpecs(specs []ListenSpec, srv *http.Server) {
+	if err := ListenAndServeSpecsE(specs, srv); err != nil {
+		log.Fatalln(err)
 	}
-	select {
-	case <-doneWG:
-	case <-timeoutChan:
-		log.Println(timeoutMsg)
+}
+
+// ListenAndServeSpecsE is like ListenAndServeSpecs but returns the error to the caller
+// instead of exiting the process.
+func ListenAndServeSpecsE(specs []ListenSpec, srv *http.Server) error {
+	return loadDefaultServer().ListenAndServeSpecs(specs, srv)
+}
+
+// ListenAndServeUnix is similar to ListenAndServe but listens on the Unix domain socket at path.
+// ListenAndServeUnix exits fatally if there is an error.
+func ListenAndServeUnix(path string, srv *http.Server) {
+	if err := ListenAndServeUnixE(path, srv); err != nil {
+		log.Fatalln(err)
 	}
-	allDoneWG.Done()
-}
-
-func acceptLoop(l net.Listener, srv *http.Server, acceptWG, requestWG *sync.WaitGroup) {
-	defer acceptWG.Done()
-	for {
-
-		// Break out of the accept loop on the next iteration after the
-		// process was signaled and our channel was closed.
-		select {
-		case <-Shutdown:
-			return
-		default:
-		}
-
-		// Set a deadline so Accept doesn't block forever, which gives
-		// us an opportunity to stop gracefully.
-		err := l.(*net.TCPListener).SetDeadline(time.Now().Add(breakAcceptInterval))
-		if err != nil {
-			log.Fatalln(err)
-		}
-
-		c, err := l.Accept()
-		if err != nil {
-			if goagain.IsErrClosing(err) {
-				return
-			}
-			if err.(*net.OpError).Timeout() {
-				continue
-			}
-			log.Fatalln(err)
-		}
-
-		// Server will spawn a goroutine for connection and will return with errSingleListen.
-		requestWG.Add(1)
-		sl := &singleListener{l: l, conn: c}
-		err = srv.Serve(sl)
-		if err == errSingleListen {
-			continue
-		}
-		if err != nil {
-			log.Fatalln(err)
-		}
+}
+
+// ListenAndServeUnixE is like ListenAndServeUnix but returns the error to the caller
+// instead of exiting the process.
+func ListenAndServeUnixE(path string, srv *http.Server) error {
+	return loadDefaultServer().ListenAndServeUnix(path, srv)
+}
+
+// ListenAndServeContext is like ListenAndServeE but also starts a graceful shutdown when ctx is done.
+func ListenAndServeContext(ctx context.Context, addr string, srv *http.Server) error {
+	return loadDefaultServer().ListenAndServeContext(ctx, addr, srv)
+}
+
+// Serve is similar to http.Serve but drains connections gracefully on shutdown.
+// Restart is not supported, see Server.Serve.
+func Serve(l net.Listener, srv *http.Server) error {
+	return loadDefaultServer().Serve(l, srv)
+}
+
+// ServeFD is like Serve but accepts connections on the listening socket fd.
+// Unlike Serve, the listener is passed to the new process on restart.
+func ServeFD(fd uintptr, srv *http.Server) error {
+	return loadDefaultServer().ServeFD(fd, srv)
+}
+
+// ListenAndServeTLS is similar to ListenAndServe but serves HTTPS.
+// Certificates are taken from srv.TLSConfig if present. Otherwise, certFile and keyFile must be given.
+// If addr is blank, ":https" is used.
+// ListenAndServeTLS exits fatally if there is an error.
+func ListenAndServeTLS(addr, certFile, keyFile string, srv *http.Server) {
+	if err := ListenAndServeTLSE(addr, certFile, keyFile, srv); err != nil {
+		log.Fatalln(err)
 	}
 }
 
-func wrapHandler(h http.Handler, wg *sync.WaitGroup) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		defer wg.Done()
-		h.ServeHTTP(w, r)
-	})
+// ListenAndServeTLSE is like ListenAndServeTLS but returns the error to the caller
+// instead of exiting the process.
+func ListenAndServeTLSE(addr, certFile, keyFile string, srv *http.Server) error {
+	return loadDefaultServer().ListenAndServeTLS(addr, certFile, keyFile, srv)
 }
+
+// SetHandler replaces the handler of the default server without a restart.
+// Subsequent requests are served by h while in-flight requests finish on the previous handler.
+func SetHandler(h http.Handler) { defaultServer.SetHandler(h) }
+
+// ReloadCertificates loads the certificate files given to ListenAndServeTLS again,
+// so new TLS handshakes use a renewed certificate without a restart.
+func ReloadCertificates() error { return defaultServer.ReloadCertificates() }
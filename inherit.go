@@ -0,0 +1,99 @@
+package httpagain
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// filer is implemented by listeners that can be passed to another process.
+type filer interface {
+	File() (*os.File, error)
+}
+
+// listenerFiles returns duplicates of listener file descriptors.
+func listenerFiles(ls []net.Listener) ([]*os.File, error) {
+	files := make([]*os.File, 0, len(ls))
+	for _, l := range ls {
+		fl, ok := l.(filer)
+		if !ok {
+			closeFiles(files)
+			return nil, fmt.Errorf("cannot pass %T to another process", l)
+		}
+		f, err := fl.File()
+		if err != nil {
+			closeFiles(files)
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// dupListeners returns listeners on duplicates of the file descriptors of ls,
+// so that ls can be closed without closing the sockets.
+// Unix socket files are not removed when ls or the duplicates are closed.
+func dupListeners(ls []net.Listener) ([]net.Listener, error) {
+	files, err := listenerFiles(ls)
+	if err != nil {
+		return nil, err
+	}
+	defer closeFiles(files)
+	dups := make([]net.Listener, 0, len(files))
+	for i, f := range files {
+		l, err := net.FileListener(f)
+		if err != nil {
+			closeListeners(dups)
+			return nil, err
+		}
+		if ul, ok := ls[i].(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+		dups = append(dups, l)
+	}
+	return dups, nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// checkExecEnv returns an error if an entry of env, set from ExecEnv, is not in the "key=value" form.
+func checkExecEnv(env []string) error {
+	for _, kv := range env {
+		if strings.Index(kv, "=") <= 0 {
+			return fmt.Errorf("invalid environment variable: %q", kv)
+		}
+	}
+	return nil
+}
+
+// execArgs returns the command line of the new process on restart: the one of the current process
+// with the arguments replaced by args, set from ExecArgs, unless it is nil.
+func execArgs(args []string) []string {
+	if args == nil {
+		return os.Args
+	}
+	return append(os.Args[:1:1], args...)
+}
+
+// execEnv returns the environment of the new process on restart: the one of the current process
+// with the entries of env, set from ExecEnv, replacing the variables with the same keys.
+// The current process is not modified, so it goes on unchanged if the restart is aborted.
+func execEnv(env []string) []string {
+	environ := os.Environ()
+	for _, kv := range env {
+		prefix := kv[:strings.Index(kv, "=")+1]
+		kept := environ[:0]
+		for _, e := range environ {
+			if !strings.HasPrefix(e, prefix) {
+				kept = append(kept, e)
+			}
+		}
+		environ = append(kept, kv)
+	}
+	return environ
+}
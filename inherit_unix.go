@@ -0,0 +1,220 @@
+//go:build !windows
+
+package httpagain
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/rcrowley/goagain"
+)
+
+// goagain passes a single listener to the next process.
+// Other listeners are passed in file descriptors listed in this environment variable.
+const envExtraFDs = "HTTPAGAIN_FDS"
+
+// inheritListeners returns the listeners passed from the parent process.
+// Only TCP and Unix listeners are accepted, since they are the only ones that can be passed on
+// to the next process again. The listeners are closed if any of them cannot be used.
+func inheritListeners() ([]net.Listener, error) {
+	l, err := goagain.Listener()
+	if err != nil {
+		return nil, err
+	}
+	ls := []net.Listener{l}
+	for _, s := range strings.Fields(strings.Replace(os.Getenv(envExtraFDs), ",", " ", -1)) {
+		var fd uintptr
+		if _, err = fmt.Sscan(s, &fd); err != nil {
+			closeListeners(ls)
+			return nil, err
+		}
+		f := os.NewFile(fd, "listener")
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			closeListeners(ls)
+			return nil, err
+		}
+		ls = append(ls, l)
+	}
+	for _, l := range ls {
+		switch l.(type) {
+		case *net.TCPListener, *net.UnixListener:
+		default:
+			closeListeners(ls)
+			return nil, fmt.Errorf("inherited listener is %T, not *net.TCPListener or *net.UnixListener", l)
+		}
+	}
+	return ls, nil
+}
+
+// forkExec is like goagain.ForkExec but passes all listeners to the child.
+// The first listener is passed the way goagain does so the child can get it with goagain.Listener.
+// The child is started with args and env applied by execArgs and execEnv.
+func forkExec(ls []net.Listener, args, env []string) error {
+	argv0, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return err
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	fds, err := listenerFDs(ls)
+	if err != nil {
+		return err
+	}
+	defer closeFDs(fds)
+
+	// Listeners are at file descriptors 3, 4, ... in the child.
+	var extra []string
+	for i := 1; i < len(fds); i++ {
+		extra = append(extra, fmt.Sprint(3+i))
+	}
+	sig := syscall.SIGQUIT
+	if goagain.Strategy == goagain.Double {
+		sig = syscall.SIGUSR2
+	}
+	addr := ls[0].Addr()
+	vars := map[string]string{
+		"GOAGAIN_FD":     "3",
+		"GOAGAIN_NAME":   fmt.Sprintf("%s:%s->", addr.Network(), addr.String()),
+		"GOAGAIN_PID":    "",
+		"GOAGAIN_PPID":   fmt.Sprint(syscall.Getpid()),
+		"GOAGAIN_SIGNAL": fmt.Sprintf("%d", sig),
+		envExtraFDs:      strings.Join(extra, ","),
+	}
+	for k, v := range vars {
+		if err = os.Setenv(k, v); err != nil {
+			return err
+		}
+	}
+
+	// os.StartProcess is not used because it puts the descriptors in blocking mode,
+	// which is shared with the listeners, and a blocking Accept is not interrupted by Close.
+	pid, err := syscall.ForkExec(argv0, execArgs(args), &syscall.ProcAttr{
+		Dir:   wd,
+		Env:   execEnv(env),
+		Files: append([]uintptr{os.Stdin.Fd(), os.Stdout.Fd(), os.Stderr.Fd()}, fds...),
+	})
+	if err != nil {
+		return err
+	}
+
+	// goagain.Kill in the re-executed parent sends SIGQUIT to this pid.
+	return os.Setenv("GOAGAIN_PID", fmt.Sprint(pid))
+}
+
+// listenerFDs returns duplicates of listener file descriptors.
+// Unlike listenerFiles, it does not change the blocking mode of the listeners.
+func listenerFDs(ls []net.Listener) ([]uintptr, error) {
+	fds := make([]uintptr, 0, len(ls))
+	for _, l := range ls {
+		sc, ok := l.(syscall.Conn)
+		if !ok {
+			closeFDs(fds)
+			return nil, fmt.Errorf("cannot pass %T to another process", l)
+		}
+		rc, err := sc.SyscallConn()
+		if err != nil {
+			closeFDs(fds)
+			return nil, err
+		}
+		var dupErr error
+		err = rc.Control(func(fd uintptr) {
+			syscall.ForkLock.RLock()
+			defer syscall.ForkLock.RUnlock()
+			var nfd int
+			if nfd, dupErr = syscall.Dup(int(fd)); dupErr == nil {
+				syscall.CloseOnExec(nfd)
+				fds = append(fds, uintptr(nfd))
+			}
+		})
+		if err == nil {
+			err = dupErr
+		}
+		if err != nil {
+			closeFDs(fds)
+			return nil, err
+		}
+	}
+	return fds, nil
+}
+
+func closeFDs(fds []uintptr) {
+	for _, fd := range fds {
+		syscall.Close(int(fd))
+	}
+}
+
+// abortChild kills the child started by forkExec and waits for it to exit.
+func abortChild() error {
+	pid, err := strconv.Atoi(os.Getenv("GOAGAIN_PID"))
+	if err != nil {
+		return err
+	}
+	if err = os.Setenv("GOAGAIN_PID", ""); err != nil {
+		return err
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	// The child may have exited already, it is reaped by Wait in any case.
+	p.Kill()
+	_, err = p.Wait()
+	if errors.Is(err, syscall.ECHILD) {
+		// Reaped already with ReapChildren.
+		return nil
+	}
+	return err
+}
+
+// execListeners is like goagain.Exec but passes all listeners to the new process,
+// which is started with args and env applied by execArgs and execEnv.
+// goagain.Exec is not used because it puts the descriptor in blocking mode, which is shared with the
+// child still accepting on it until the new process is serving, and the child could not stop accepting then.
+func execListeners(ls []net.Listener, args, env []string) error {
+	if len(ls) == 0 {
+		return errors.New("no listener to pass")
+	}
+	argv0, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return err
+	}
+	fds, err := listenerFDs(ls)
+	if err != nil {
+		return err
+	}
+	defer closeFDs(fds)
+
+	// Keep the descriptors open across exec.
+	var extra []string
+	for i, fd := range fds {
+		if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_SETFD, 0); errno != 0 {
+			return errno
+		}
+		if i > 0 {
+			extra = append(extra, fmt.Sprint(fd))
+		}
+	}
+	addr := ls[0].Addr()
+	vars := map[string]string{
+		"GOAGAIN_FD":     fmt.Sprint(fds[0]),
+		"GOAGAIN_NAME":   fmt.Sprintf("%s:%s->", addr.Network(), addr.String()),
+		"GOAGAIN_SIGNAL": fmt.Sprintf("%d", syscall.SIGQUIT),
+		envExtraFDs:      strings.Join(extra, ","),
+	}
+	for k, v := range vars {
+		if err = os.Setenv(k, v); err != nil {
+			return err
+		}
+	}
+	return syscall.Exec(argv0, execArgs(args), execEnv(env))
+}
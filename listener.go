@@ -3,43 +3,70 @@ package httpagain
 import (
 	"errors"
 	"net"
+	"strings"
 	"sync"
 )
 
-// errSingleListen is returned on second call to Accept().
-var errSingleListen = errors.New("errSingleListen")
+// errListenerClosed is returned from Accept after the listener is closed.
+var errListenerClosed = errors.New("listener closed")
 
-// singleListener is a net.Listener that returns a single connection.
-type singleListener struct {
-	l    net.Listener
-	conn net.Conn
-	once sync.Once
+// IsClosingError tells whether err is returned because the listener or connection is closed.
+// The accept loop uses it to tell a closed listener from an error to handle with AcceptErrorHandler.
+// Errors that are not wrapped properly are matched by their message, like goagain.IsErrClosing does.
+func IsClosingError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, net.ErrClosed) || errors.Is(err, errListenerClosed) {
+		return true
+	}
+	return strings.Contains(err.Error(), "use of closed network connection")
+}
+
+// connListener is a net.Listener that returns the connections accepted by the accept loop.
+// http.Server serves a connListener for the lifetime of the listener,
+// so it manages its connections the same way it does for a normal listener.
+// http.Server takes each connection in its accept loop and serves it in a new goroutine,
+// so handing a connection over does not wait for any work on the connection.
+type connListener struct {
+	addr  net.Addr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{
+		addr:  addr,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// push hands c to the server. It returns false if the listener is closed.
+func (l *connListener) push(c net.Conn) bool {
+	select {
+	case l.conns <- c:
+		return true
+	case <-l.done:
+		return false
+	}
 }
 
-func (s *singleListener) Accept() (net.Conn, error) {
-	var c net.Conn
-	s.once.Do(func() {
-		c = s.conn
-	})
-	if c != nil {
-		// Wrap net.Listener, storing timeout parameters.
-		tc := &timeoutConn{
-			Conn:         c,
-			readTimeout:  TCPReadTimeout,
-			writeTimeout: TCPWriteTimeout,
-		}
-		return tc, nil
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, errListenerClosed
 	}
-	return nil, errSingleListen
 }
 
-func (s *singleListener) Close() (err error) {
-	s.once.Do(func() {
-		err = s.conn.Close()
-	})
-	return
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
 }
 
-func (s *singleListener) Addr() net.Addr {
-	return s.l.Addr()
+func (l *connListener) Addr() net.Addr {
+	return l.addr
 }
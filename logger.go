@@ -0,0 +1,24 @@
+package httpagain
+
+import (
+	"fmt"
+	"log"
+	"os"
+)
+
+// Logger is the interface used for logging by Server.
+// *log.Logger satisfies this interface.
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+// defaultLogger writes to stderr prefixed with the pid of the process
+// so the parent and the child can be told apart during restart.
+var defaultLogger Logger = log.New(os.Stderr, fmt.Sprintf("pid:%d ", os.Getpid()), log.Lmicroseconds|log.Lshortfile)
+
+func (s *Server) logger() Logger {
+	if s.Log != nil {
+		return s.Log
+	}
+	return defaultLogger
+}
@@ -0,0 +1,64 @@
+package httpagain
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"sync/atomic"
+)
+
+// MetricsHandler returns a handler that writes the counters of the server in the Prometheus text format,
+// so they can be scraped without a metrics library. Mount it on an internal listener.
+// Metric names are prefixed with "httpagain_". Counters start from zero when the process is re-executed,
+// except the number of restarts.
+func (s *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var b bytes.Buffer
+		metric := func(name, typ, help string, v float64) {
+			fmt.Fprintf(&b, "# HELP httpagain_%s %s\n# TYPE httpagain_%s %s\nhttpagain_%s %g\n", name, help, name, typ, name, v)
+		}
+		metric("active_connections", "gauge", "Open connections.", float64(s.ActiveConnections()))
+		metric("active_requests", "gauge", "Requests being handled.", float64(s.ActiveRequests()))
+		metric("active_goroutines", "gauge", "Goroutines tracked with Begin and End.", float64(s.ActiveGoroutines()))
+		metric("bytes_read_total", "counter", "Bytes read from connections.", float64(s.BytesRead()))
+		metric("bytes_written_total", "counter", "Bytes written to connections.", float64(s.BytesWritten()))
+		metric("restarts_total", "counter", "Graceful restarts since the process is started.", float64(RestartCount()))
+		metric("last_drain_duration_seconds", "gauge", "Duration of the last drain.", s.LastDrainDuration().Seconds())
+		shuttingDown := 0.0
+		if s.IsShuttingDown() {
+			shuttingDown = 1
+		}
+		metric("shutting_down", "gauge", "Whether the server is draining.", shuttingDown)
+
+		b.WriteString("# HELP httpagain_requests_total Requests by protocol.\n# TYPE httpagain_requests_total counter\n")
+		byProto := s.RequestsByProtocol()
+		protos := make([]string, 0, len(byProto))
+		for p := range byProto {
+			protos = append(protos, p)
+		}
+		sort.Strings(protos)
+		for _, p := range protos {
+			fmt.Fprintf(&b, "httpagain_requests_total{protocol=%q} %d\n", p, byProto[p])
+		}
+
+		b.WriteString("# HELP httpagain_requests_per_connection Requests served by closed connections.\n# TYPE httpagain_requests_per_connection histogram\n")
+		var count int64
+		for _, bucket := range s.RequestsPerConnHistogram() {
+			count += bucket.Count
+			le := "+Inf"
+			if bucket.Max != math.MaxInt64 {
+				le = fmt.Sprint(bucket.Max)
+			}
+			fmt.Fprintf(&b, "httpagain_requests_per_connection_bucket{le=%q} %d\n", le, count)
+		}
+		fmt.Fprintf(&b, "httpagain_requests_per_connection_sum %d\nhttpagain_requests_per_connection_count %d\n", atomic.LoadInt64(&s.reqsOfConns), count)
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(b.Bytes())
+	})
+}
+
+// MetricsHandler returns a metrics handler for the server started with ListenAndServe.
+func MetricsHandler() http.Handler { return defaultServer.MetricsHandler() }
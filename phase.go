@@ -0,0 +1,90 @@
+package httpagain
+
+import "time"
+
+// Phases of draining, passed to Server.OnPhase.
+// The drain phases are skipped if Server.FastShutdown is set.
+const (
+	// PhaseStopAccepting waits for the accept loops to stop accepting new connections.
+	PhaseStopAccepting = "stop accepting"
+
+	// PhaseLameDuck keeps serving the open connections for LameDuckDuration on shutdown.
+	PhaseLameDuck = "lame duck"
+
+	// PhaseShutdownHooks runs the functions registered with RegisterOnShutdown, up to HookGracePeriod.
+	PhaseShutdownHooks = "shutdown hooks"
+
+	// PhaseDrainRequests waits for active requests, up to RequestGracePeriod.
+	PhaseDrainRequests = "drain requests"
+
+	// PhaseDrainHijacked waits for hijacked connections to be closed, up to HijackGracePeriod.
+	PhaseDrainHijacked = "drain hijacked connections"
+
+	// PhaseDrainGoroutines waits for goroutines tracked with Begin and End, up to GoroutineGracePeriod.
+	PhaseDrainGoroutines = "drain goroutines"
+
+	// PhaseExec re-executes the process on restart.
+	PhaseExec = "exec"
+
+	// PhaseExit is entered before returning from ListenAndServe.
+	PhaseExit = "exit"
+)
+
+// enterPhase logs phase and calls OnPhase.
+func (s *Server) enterPhase(phase string) {
+	s.logger().Printf("shutdown phase: %s", phase)
+	if s.OnPhase != nil {
+		s.OnPhase(phase)
+	}
+}
+
+// LastDrainDuration returns how long the last drain took, from when the server started shutting down
+// until all phases finished, e.g. to tune the grace periods. It is zero if the server has not drained yet.
+// The process re-executed on restart gets the duration of the drain before the restart.
+func (s *Server) LastDrainDuration() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lastDrain == 0 {
+		return inheritedDrain
+	}
+	return s.lastDrain
+}
+
+// recordDrain records and logs the duration of a drain.
+func (s *Server) recordDrain(d time.Duration) {
+	s.mu.Lock()
+	s.lastDrain = d
+	s.mu.Unlock()
+	s.logger().Printf("drained in %s", d)
+}
+
+// gracePeriod converts a grace period setting to the timeout of waitTimeout, where 0 means no limit.
+func gracePeriod(d time.Duration) time.Duration {
+	switch {
+	case d < 0:
+		return 0
+	case d == 0 && !ZeroWaitsForever:
+		return noWait
+	default:
+		return d
+	}
+}
+
+// noWait is the timeout of waitTimeout that does not wait, it only checks whether the work is finished.
+const noWait time.Duration = -1
+
+// phaseTimeout returns timeout limited to the time left until deadline.
+// Zero timeout or deadline means no limit. If deadline has passed, noWait is returned.
+func (s *Server) phaseTimeout(timeout time.Duration, deadline time.Time) time.Duration {
+	if deadline.IsZero() || timeout == noWait {
+		return timeout
+	}
+	left := deadline.Sub(s.clock().Now())
+	if left <= 0 {
+		return noWait
+	}
+	if timeout == 0 || left < timeout {
+		return left
+	}
+	return timeout
+}
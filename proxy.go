@@ -0,0 +1,159 @@
+package httpagain
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// proxyV2Signature starts every PROXY protocol version 2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyV1MaxLen is the maximum length of a PROXY protocol version 1 header line, including CRLF.
+const proxyV1MaxLen = 107
+
+var errProxyHeader = errors.New("httpagain: malformed PROXY protocol header")
+
+// proxyConn wraps a net.Conn and reads the PROXY protocol header sent by a load balancer
+// before the first byte of the HTTP stream. RemoteAddr returns the client address from the header.
+// The header is read on the first call to Read or RemoteAddr, in the goroutine serving the connection,
+// so a slow client does not block the accept loop.
+type proxyConn struct {
+	net.Conn
+	r          *bufio.Reader
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+func newProxyConn(c net.Conn) *proxyConn {
+	return &proxyConn{Conn: c, r: bufio.NewReader(c)}
+}
+
+// readHeader reads the header once. The connection is closed if the header is malformed,
+// so that garbage is not passed to the HTTP parser.
+func (c *proxyConn) readHeader() error {
+	c.once.Do(func() {
+		c.remoteAddr, c.err = readProxyHeader(c.r)
+		if c.err != nil {
+			c.Conn.Close()
+		}
+	})
+	return c.err
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	if err := c.readHeader(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.readHeader() != nil || c.remoteAddr == nil {
+		return c.Conn.RemoteAddr()
+	}
+	return c.remoteAddr
+}
+
+// readProxyHeader reads a version 1 or version 2 header from r.
+// The returned address is nil if the header does not carry the client address,
+// e.g. for health checks of the load balancer.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	// Peek blocks until enough bytes arrive, so a header split across reads is handled.
+	// Both versions of the header are longer than the signature.
+	b, err := r.Peek(len(proxyV2Signature))
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(b, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	return readProxyV1(r)
+}
+
+// readProxyV1 reads a header line like "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n".
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLen {
+			return nil, errProxyHeader
+		}
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errProxyHeader
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, errProxyHeader
+	}
+	if len(fields) != 6 {
+		return nil, errProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (ip.To4() != nil) != (fields[1] == "TCP4") || net.ParseIP(fields[3]) == nil {
+		return nil, errProxyHeader
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, errProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads a binary header.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, errProxyHeader
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	switch hdr[12] & 0xf {
+	case 0: // LOCAL
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, errProxyHeader
+	}
+	var ipLen int
+	switch hdr[13] >> 4 {
+	case 1: // AF_INET
+		ipLen = net.IPv4len
+	case 2: // AF_INET6
+		ipLen = net.IPv6len
+	default:
+		// Unix sockets and unspecified families carry no client IP.
+		return nil, nil
+	}
+	if len(payload) < 2*ipLen+4 {
+		return nil, errProxyHeader
+	}
+	ip := make(net.IP, ipLen)
+	copy(ip, payload[:ipLen])
+	port := binary.BigEndian.Uint16(payload[2*ipLen:])
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
@@ -0,0 +1,56 @@
+package httpagain
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket shared by the accept loops of a server.
+// It holds up to one second worth of tokens, so short bursts are accepted without waiting.
+type rateLimiter struct {
+	mu     sync.Mutex
+	clock  Clock
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, clock Clock) *rateLimiter {
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{clock: clock, rate: rate, burst: burst, tokens: burst, last: clock.Now()}
+}
+
+// reserve takes a token and returns how long to wait before using it.
+func (r *rateLimiter) reserve() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.clock.Now()
+	r.tokens += now.Sub(r.last).Seconds() * r.rate
+	if r.tokens > r.burst {
+		r.tokens = r.burst
+	}
+	r.last = now
+	r.tokens--
+	if r.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-r.tokens / r.rate * float64(time.Second))
+}
+
+// wait blocks until a token is available. It returns false if stopping is closed before that.
+func (r *rateLimiter) wait(stopping <-chan struct{}) bool {
+	d := r.reserve()
+	if d <= 0 {
+		return true
+	}
+	select {
+	case <-r.clock.After(d):
+		return true
+	case <-stopping:
+		return false
+	}
+}
@@ -0,0 +1,42 @@
+//go:build !windows
+
+package httpagain
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+var reapOnce sync.Once
+
+// startReaper reaps every child process that exits, for ReapChildren.
+func startReaper() {
+	reapOnce.Do(func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGCHLD)
+		go func() {
+			for range c {
+				reapChildren()
+			}
+		}()
+		// Children may have exited before SIGCHLD is handled.
+		reapChildren()
+	})
+}
+
+// reapChildren waits for the child processes that have exited, without blocking.
+// SIGCHLD signals are coalesced, so all of them are waited for one signal.
+func reapChildren() {
+	for {
+		var ws syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &ws, syscall.WNOHANG, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if pid <= 0 || err != nil {
+			return
+		}
+	}
+}
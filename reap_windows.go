@@ -0,0 +1,4 @@
+package httpagain
+
+// startReaper does nothing on Windows, where exited processes do not become zombies.
+func startReaper() {}
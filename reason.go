@@ -0,0 +1,49 @@
+package httpagain
+
+// Reason tells why a server stopped serving.
+type Reason int
+
+const (
+	// ReasonShutdown means the server is shut down and the process is going to exit.
+	ReasonShutdown Reason = iota
+
+	// ReasonRestart means a new process takes over the listeners of the server.
+	ReasonRestart
+)
+
+func (r Reason) String() string {
+	switch r {
+	case ReasonShutdown:
+		return "shutdown"
+	case ReasonRestart:
+		return "restart"
+	default:
+		return "unknown"
+	}
+}
+
+// Reason returns why the server stopped serving. It is valid after Done is closed.
+func (s *Server) Reason() Reason {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reason
+}
+
+// Exec re-executes the process passing the listeners of the server.
+// It is only needed if DeferExec is set and Reason is ReasonRestart.
+// Exec does not return if it succeeds.
+func (s *Server) Exec() error {
+	s.mu.Lock()
+	ls := s.listeners
+	s.mu.Unlock()
+	if err := checkExecEnv(s.ExecEnv); err != nil {
+		return err
+	}
+	if err := setHandoffEnv(); err != nil {
+		return err
+	}
+	if err := setDrainEnv(s.LastDrainDuration()); err != nil {
+		return err
+	}
+	return s.restarter().Exec(ls)
+}
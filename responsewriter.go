@@ -0,0 +1,130 @@
+package httpagain
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+)
+
+// responseWriter wraps an http.ResponseWriter and records the status code and the number of bytes written.
+// Use newResponseWriter to get a writer that keeps the optional interfaces of the wrapped one.
+type responseWriter struct {
+	w        http.ResponseWriter
+	status   int
+	bytes    int64
+	hijacked bool
+}
+
+func (w *responseWriter) Header() http.Header { return w.w.Header() }
+
+func (w *responseWriter) WriteHeader(status int) {
+	// Informational responses are followed by the final one.
+	if w.status == 0 && status >= 200 {
+		w.status = status
+	}
+	w.w.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.w.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap returns the wrapped writer for http.ResponseController.
+func (w *responseWriter) Unwrap() http.ResponseWriter { return w.w }
+
+// Status returns the status code sent to the client.
+// It is http.StatusOK if the handler has not written anything,
+// since that is what http.Server sends when the handler returns.
+// It is 0 if the connection is hijacked.
+func (w *responseWriter) Status() int {
+	if w.hijacked {
+		return 0
+	}
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+type flusher struct{ *responseWriter }
+
+func (w flusher) Flush() {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.w.(http.Flusher).Flush()
+}
+
+type hijacker struct{ *responseWriter }
+
+func (w hijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	c, rw, err := w.w.(http.Hijacker).Hijack()
+	if err == nil {
+		w.hijacked = true
+	}
+	return c, rw, err
+}
+
+type pusher struct{ *responseWriter }
+
+func (w pusher) Push(target string, opts *http.PushOptions) error {
+	return w.w.(http.Pusher).Push(target, opts)
+}
+
+// newResponseWriter wraps w. The returned writer implements http.Flusher, http.Hijacker and
+// http.Pusher only if w does, so handlers checking for them behave the same.
+func newResponseWriter(w http.ResponseWriter) (http.ResponseWriter, *responseWriter) {
+	rw := &responseWriter{w: w}
+	_, f := w.(http.Flusher)
+	_, h := w.(http.Hijacker)
+	_, p := w.(http.Pusher)
+	switch {
+	case f && h && p:
+		return struct {
+			*responseWriter
+			flusher
+			hijacker
+			pusher
+		}{rw, flusher{rw}, hijacker{rw}, pusher{rw}}, rw
+	case f && h:
+		return struct {
+			*responseWriter
+			flusher
+			hijacker
+		}{rw, flusher{rw}, hijacker{rw}}, rw
+	case f && p:
+		return struct {
+			*responseWriter
+			flusher
+			pusher
+		}{rw, flusher{rw}, pusher{rw}}, rw
+	case h && p:
+		return struct {
+			*responseWriter
+			hijacker
+			pusher
+		}{rw, hijacker{rw}, pusher{rw}}, rw
+	case f:
+		return struct {
+			*responseWriter
+			flusher
+		}{rw, flusher{rw}}, rw
+	case h:
+		return struct {
+			*responseWriter
+			hijacker
+		}{rw, hijacker{rw}}, rw
+	case p:
+		return struct {
+			*responseWriter
+			pusher
+		}{rw, pusher{rw}}, rw
+	default:
+		return rw, rw
+	}
+}
@@ -0,0 +1,42 @@
+package httpagain
+
+import (
+	"net"
+	"os"
+)
+
+// Restarter performs the process level operations of a graceful restart.
+// The default one passes listeners with goagain and relays real signals.
+// On Windows, the default one only relays signals, forking and executing a process is not supported.
+// Tests can replace it with a fake that simulates a restart by sending signals to the channel
+// given to Notify, without forking or re-executing the process.
+type Restarter interface {
+	// Listeners returns the listeners passed from the parent process.
+	// It returns an error if the process is not started by a restart.
+	Listeners() ([]net.Listener, error)
+
+	// Kill tells the other process of the restart that this process is serving, like goagain.Kill.
+	Kill() error
+
+	// Notify relays the signals to c, like signal.Notify.
+	Notify(c chan<- os.Signal, sig ...os.Signal)
+
+	// StopNotify stops relaying signals to c, like signal.Stop.
+	StopNotify(c chan<- os.Signal)
+
+	// ForkExec starts a child process passing ls.
+	ForkExec(ls []net.Listener) error
+
+	// Abort stops the child process started by ForkExec if it does not become ready.
+	Abort() error
+
+	// Exec replaces the process with a new one passing ls. It does not return if it succeeds.
+	Exec(ls []net.Listener) error
+}
+
+func (s *Server) restarter() Restarter {
+	if s.Restarter != nil {
+		return s.Restarter
+	}
+	return newDefaultRestarter(s.ExecArgs, s.ExecEnv)
+}
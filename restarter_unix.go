@@ -0,0 +1,48 @@
+//go:build !windows
+
+package httpagain
+
+import (
+	"net"
+	"os"
+	"os/signal"
+
+	"github.com/rcrowley/goagain"
+)
+
+func init() {
+	// Use double-fork strategy from goagain package.
+	// After restart pid does not changes.
+	// This plays nicely with process managers such as upstart, supervisord, etc.
+	goagain.Strategy = goagain.Double
+}
+
+// newDefaultRestarter returns the default Restarter, which starts new processes with args and env
+// set from ExecArgs and ExecEnv.
+func newDefaultRestarter(args, env []string) Restarter { return goagainRestarter{args: args, env: env} }
+
+// goagainRestarter is the default Restarter.
+type goagainRestarter struct {
+	args []string
+	env  []string
+}
+
+func (goagainRestarter) Listeners() ([]net.Listener, error) { return inheritListeners() }
+
+func (goagainRestarter) Kill() error {
+	// No process waits for us if we are re-executed in place.
+	if !hasHandoffPeer() {
+		return nil
+	}
+	return goagain.Kill()
+}
+
+func (goagainRestarter) Notify(c chan<- os.Signal, sig ...os.Signal) { signal.Notify(c, sig...) }
+
+func (goagainRestarter) StopNotify(c chan<- os.Signal) { signal.Stop(c) }
+
+func (r goagainRestarter) ForkExec(ls []net.Listener) error { return forkExec(ls, r.args, r.env) }
+
+func (goagainRestarter) Abort() error { return abortChild() }
+
+func (r goagainRestarter) Exec(ls []net.Listener) error { return execListeners(ls, r.args, r.env) }
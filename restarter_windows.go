@@ -0,0 +1,31 @@
+package httpagain
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/signal"
+)
+
+var errRestartNotSupported = errors.New("httpagain: restart is not supported on Windows")
+
+// newDefaultRestarter returns the default Restarter. args and env are not used since processes are not started.
+func newDefaultRestarter(args, env []string) Restarter { return windowsRestarter{} }
+
+// windowsRestarter is the default Restarter on Windows.
+// Listeners are not passed between processes, so the server can only be shut down.
+type windowsRestarter struct{}
+
+func (windowsRestarter) Listeners() ([]net.Listener, error) { return nil, errRestartNotSupported }
+
+func (windowsRestarter) Kill() error { return errRestartNotSupported }
+
+func (windowsRestarter) Notify(c chan<- os.Signal, sig ...os.Signal) { signal.Notify(c, sig...) }
+
+func (windowsRestarter) StopNotify(c chan<- os.Signal) { signal.Stop(c) }
+
+func (windowsRestarter) ForkExec(ls []net.Listener) error { return errRestartNotSupported }
+
+func (windowsRestarter) Abort() error { return errRestartNotSupported }
+
+func (windowsRestarter) Exec(ls []net.Listener) error { return errRestartNotSupported }
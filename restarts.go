@@ -0,0 +1,112 @@
+package httpagain
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The number of restarts, the time of the last one, the handoff data and the duration of the last drain
+// are passed to new processes in these environment variables.
+const (
+	envRestarts    = "HTTPAGAIN_RESTARTS"
+	envLastRestart = "HTTPAGAIN_LAST_RESTART"
+	envHandoffData = "HTTPAGAIN_HANDOFF_DATA"
+	envLastDrain   = "HTTPAGAIN_LAST_DRAIN"
+)
+
+// Read once at start, so they do not change when the variables are set for the next process.
+var (
+	restartCount, _ = strconv.Atoi(os.Getenv(envRestarts))
+	lastRestart     = parseUnixNano(os.Getenv(envLastRestart))
+	handoffData, _  = base64.StdEncoding.DecodeString(os.Getenv(envHandoffData))
+	inheritedDrain  = parseNano(os.Getenv(envLastDrain))
+)
+
+// MaxHandoffData is the maximum size of the data given to SetHandoffData.
+// The data is passed in an environment variable, and Linux limits a variable to 128 KiB.
+const MaxHandoffData = 64 << 10
+
+var errHandoffDataTooLarge = errors.New("httpagain: handoff data is larger than MaxHandoffData")
+
+var (
+	nextHandoffMu   sync.Mutex
+	nextHandoffData []byte
+	nextHandoffSet  bool
+)
+
+// HandoffData returns the data set with SetHandoffData in the process that started this one on restart.
+// It is nil if the process is not restarted or no data is set.
+func HandoffData() []byte { return handoffData }
+
+// SetHandoffData sets data to pass to the processes started on restart, which get it with HandoffData.
+// It is meant for small state like a generation counter or a marker of a warm cache, not for bulk data.
+// The data is written when the processes are started, so it can be set as late as in a shutdown hook
+// for the re-executed process. If it is never called, the data this process got is passed on.
+func SetHandoffData(data []byte) error {
+	if len(data) > MaxHandoffData {
+		return errHandoffDataTooLarge
+	}
+	nextHandoffMu.Lock()
+	nextHandoffData = append([]byte(nil), data...)
+	nextHandoffSet = true
+	nextHandoffMu.Unlock()
+	return nil
+}
+
+// setHandoffEnv sets the variable of the handoff data for the next process.
+func setHandoffEnv() error {
+	nextHandoffMu.Lock()
+	data, set := nextHandoffData, nextHandoffSet
+	nextHandoffMu.Unlock()
+	if !set {
+		return nil
+	}
+	if len(data) == 0 {
+		return os.Unsetenv(envHandoffData)
+	}
+	return os.Setenv(envHandoffData, base64.StdEncoding.EncodeToString(data))
+}
+
+// RestartCount returns how many times the process is restarted gracefully since it is started.
+// It counts restarts across re-executions, which is useful to alert on restart loops.
+func RestartCount() int { return restartCount }
+
+// LastRestart returns the time of the last graceful restart of the process.
+// It is the zero time if the process is not restarted.
+func LastRestart() time.Time { return lastRestart }
+
+// setRestartEnv sets the variables that the processes started for the restart will read.
+func setRestartEnv() error {
+	if err := os.Setenv(envRestarts, strconv.Itoa(restartCount+1)); err != nil {
+		return err
+	}
+	if err := setHandoffEnv(); err != nil {
+		return err
+	}
+	return os.Setenv(envLastRestart, strconv.FormatInt(time.Now().UnixNano(), 10))
+}
+
+// setDrainEnv sets the variable of the duration of the last drain for the next process.
+func setDrainEnv(d time.Duration) error {
+	if d == 0 {
+		return nil
+	}
+	return os.Setenv(envLastDrain, strconv.FormatInt(int64(d), 10))
+}
+
+func parseNano(s string) time.Duration {
+	n, _ := strconv.ParseInt(s, 10, 64)
+	return time.Duration(n)
+}
+
+func parseUnixNano(s string) time.Time {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
@@ -0,0 +1,20 @@
+//go:build linux
+
+package httpagain
+
+import "syscall"
+
+// soReusePort is SO_REUSEPORT on Linux, which is missing in the syscall package.
+const soReusePort = 0xf
+
+// reusePortControl sets SO_REUSEPORT on the socket before it is bound.
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
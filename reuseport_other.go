@@ -0,0 +1,14 @@
+//go:build !linux
+
+package httpagain
+
+import (
+	"errors"
+	"syscall"
+)
+
+var errReusePortNotSupported = errors.New("httpagain: ReusePort is only supported on Linux")
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return errReusePortNotSupported
+}
@@ -0,0 +1,1549 @@
+package httpagain
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Server holds the settings and state of a graceful HTTP server.
+// Unlike the package-level functions, each Server tracks its own requests and goroutines,
+// so servers with different settings can run in the same process.
+// The zero value is a server with no timeouts; use NewServer to get the package defaults.
+type Server struct {
+	// RequestGracePeriod is the duration to wait for active requests
+	// to finish before restarting/shutting down the server. Set WaitForever to wait indefinitely.
+	RequestGracePeriod time.Duration
+
+	// GoroutineGracePeriod is the duration to wait for running goroutines (tracked with Begin() and End() calls)
+	// to finish before restarting/shutting down the server. Set WaitForever to wait indefinitely.
+	GoroutineGracePeriod time.Duration
+
+	// TCPReadTimeout for read operations on connections. Set 0 to disable.
+	// A client that sends nothing is disconnected TCPReadTimeout after it is accepted,
+	// even before the connection is read.
+	// The timeouts of http.Server take precedence: TCPReadTimeout is not applied if
+	// srv.ReadTimeout or srv.ReadHeaderTimeout is set, and it does not cut a keep-alive
+	// connection waiting for the next request if srv.IdleTimeout is set.
+	TCPReadTimeout time.Duration
+
+	// TCPWriteTimeout for write operations on connections. Set 0 to disable.
+	// It is not applied if srv.WriteTimeout is set.
+	TCPWriteTimeout time.Duration
+
+	// HeaderReadTimeout limits the total time to read the request headers. It starts when a connection is accepted,
+	// so it includes the TLS handshake, and for the next requests on a keep-alive HTTP/1 connection when their
+	// first byte is read. Unlike TCPReadTimeout, it cannot be extended by a client sending the headers slowly.
+	// Set 0 to disable.
+	HeaderReadTimeout time.Duration
+
+	// DrainWriteTimeout replaces TCPWriteTimeout for write operations once the server starts shutting down,
+	// so a slow client cannot keep a streaming response, and the process, alive for long while draining.
+	// It is applied even if srv.WriteTimeout is set. Set 0 to keep using TCPWriteTimeout.
+	DrainWriteTimeout time.Duration
+
+	// TCPKeepAlivePeriod is the period of TCP keep-alive probes on accepted connections,
+	// which detect dead peers of long-lived connections. Set 0 to use the default of the net package
+	// (keep-alives are enabled with a period of 15 seconds), negative to disable keep-alives.
+	TCPKeepAlivePeriod time.Duration
+
+	// HookGracePeriod is the duration to wait for functions registered with RegisterOnShutdown
+	// to finish before draining continues. Set WaitForever to wait indefinitely.
+	HookGracePeriod time.Duration
+
+	// MaxDrainTimeout is the maximum duration of waiting for requests, hijacked connections and goroutines
+	// after shutdown hooks are finished. The server restarts/shuts down after this period
+	// even if a grace period above is WaitForever or longer. Remaining connections are closed. Set 0 to disable.
+	MaxDrainTimeout time.Duration
+
+	// ShutdownDeadline is the absolute limit of shutting down, from the time a signal is received or Stop is called.
+	// If draining is not finished by then, whatever the periods above are, outstanding work is logged and
+	// the process exits with status 1, or is re-executed on restart. Unlike MaxDrainTimeout, it also covers
+	// shutdown hooks and does not wait for anything. Set 0 to disable.
+	ShutdownDeadline time.Duration
+
+	// FastShutdown skips draining, e.g. for quick restarts during development.
+	// Connections are closed as soon as the server stops accepting and shutdown hooks finish,
+	// without waiting for requests, hijacked connections or goroutines.
+	// It does not depend on ZeroWaitsForever, nothing is waited even if the grace periods above are 0.
+	FastShutdown bool
+
+	// LameDuckDuration is how long the server keeps serving the open connections on shutdown after it stops
+	// accepting new ones, before draining starts. Health checks fail meanwhile, so a load balancer that is
+	// slow to notice has time to move the traffic to other servers. Keep-alive connections are not closed
+	// and their new requests are served. It does not apply to restarts, where the new process keeps accepting.
+	// Set 0 to start draining right away.
+	LameDuckDuration time.Duration
+
+	// OnPhase is called when draining enters a new phase. Phases are entered in order:
+	// PhaseStopAccepting, PhaseLameDuck if LameDuckDuration is set, PhaseShutdownHooks, PhaseDrainRequests,
+	// PhaseDrainHijacked, PhaseDrainGoroutines and finally PhaseExec or PhaseExit.
+	// Each drain phase waits up to its own grace period.
+	OnPhase func(phase string)
+
+	// OnDrainTimeout is called when a drain phase or the shutdown hooks do not finish in their grace period,
+	// with the number of requests and goroutines tracked with Begin and End that are still active then,
+	// e.g. to alert on drain timeouts. It is called before the outstanding connections are closed.
+	OnDrainTimeout func(outstandingRequests, outstandingGoroutines int)
+
+	// BreakAcceptInterval was how often the accept loop woke up to check if the server is stopping.
+	//
+	// Deprecated: The accept loop is stopped by closing the listener, so it does not wake up periodically.
+	// BreakAcceptInterval is ignored.
+	BreakAcceptInterval time.Duration
+
+	// HijackGracePeriod is the duration to wait for hijacked connections, e.g. WebSockets, to be closed
+	// before restarting/shutting down the server. Remaining hijacked connections are closed after this period.
+	// Handlers of hijacked connections are not counted as active requests. They should watch
+	// ShutdownNotify(r.Context()), which is closed when draining starts, and close the connection
+	// gracefully, e.g. by sending a WebSocket close frame. Set WaitForever to wait indefinitely.
+	// It defaults to RequestGracePeriod.
+	HijackGracePeriod time.Duration
+
+	// IdleTimeout closes connections that stay without an active request longer than this duration.
+	// It applies in addition to srv.IdleTimeout, the shorter one closes the connection.
+	// Unlike TCPReadTimeout, which limits a single read, it limits the time a keep-alive connection
+	// waits for the next request. Set 0 to disable.
+	IdleTimeout time.Duration
+
+	// MaxConnections is the maximum number of open connections.
+	// New connections are not accepted until an open connection is closed. Set 0 to disable.
+	MaxConnections int
+
+	// AcceptRateLimit is the maximum number of connections accepted per second on all listeners.
+	// Connections beyond the rate wait in the accept queue of the listener. Bursts up to one second
+	// worth of connections are accepted without waiting. Set 0 to disable.
+	AcceptRateLimit float64
+
+	// MaxConcurrentRequests is the maximum number of requests handled at the same time.
+	// Requests beyond it are responded with 503 right away instead of waiting, so an overloaded server
+	// sheds load rather than slowing down every request. Each HTTP/2 stream is a request. Set 0 to disable.
+	MaxConcurrentRequests int
+
+	// OverloadRetryAfter is sent in the Retry-After header of the responses to the requests rejected
+	// by MaxConcurrentRequests, rounded up to seconds. Set 0 to omit the header.
+	OverloadRetryAfter time.Duration
+
+	// OverloadBody is the body of the responses to the requests rejected by MaxConcurrentRequests.
+	// If empty, "Service Unavailable" is used.
+	OverloadBody string
+
+	// ReusePort makes the server bind its own listeners with SO_REUSEPORT instead of
+	// using the ones passed from the parent process, so the old and new processes
+	// accept on separate sockets during restart. Listeners are still passed to keep
+	// the restart handshake working, but they are closed in the new process.
+	// Connections waiting in the accept queue of a closed socket are dropped by the kernel.
+	// Only supported on Linux.
+	ReusePort bool
+
+	// ListenConfig is used to create new listeners, e.g. to set socket options in Control.
+	// Listeners passed from the parent process on restart are not created again, so their options
+	// are the ones set by the first process. If nil, the zero value is used.
+	ListenConfig *net.ListenConfig
+
+	// Network is the network of TCP listeners: "tcp", "tcp4" or "tcp6".
+	// Use "tcp4" or "tcp6" to listen only on IPv4 or IPv6 addresses in dual-stack environments.
+	// If empty, "tcp" is used.
+	Network string
+
+	// Strategy is the way the server restarts. The default is DoubleFork.
+	// Use ExecInPlace under supervisors that do not allow the process to start another one.
+	Strategy Strategy
+
+	// BeforeExec is called when a restart signal is received, before the new process is started.
+	// It can check that the new binary and its configuration are sane, e.g. by running it with a check flag.
+	// If it returns an error, the restart is aborted and the server goes on serving as if no signal was received.
+	// BeforeExec runs before draining starts, because the child process is started from the new binary
+	// while the server is still serving.
+	BeforeExec func() error
+
+	// AfterChildReady is called in the parent when the child process started on restart is serving,
+	// after the parent stops accepting and before it starts draining. Unlike the functions registered
+	// with RegisterOnShutdown, it is called only when the restart succeeds, e.g. to report that the new
+	// version is live. It is not called with ExecInPlace.
+	AfterChildReady func()
+
+	// ExecArgs replaces the command line arguments, without the program name, of the new process on restart.
+	// If nil, the arguments of the current process are used.
+	ExecArgs []string
+
+	// ExecEnv has "key=value" entries that are added to the environment of the new process on restart.
+	// Existing variables with the same key are replaced. ExecArgs and ExecEnv do not change the current process,
+	// which goes on with its own arguments and environment if the restart is aborted.
+	ExecEnv []string
+
+	// HandoffTimeout is the duration to wait for the child process to start serving on restart.
+	// The server keeps serving until the child is ready. If the child does not become ready
+	// in this period, it is killed and the restart is aborted. Set 0 to wait indefinitely.
+	HandoffTimeout time.Duration
+
+	// Warmup is called before the server starts accepting connections, e.g. to prime caches or fill
+	// connection pools. On restart, the new process tells the old one to drain only after Warmup returns,
+	// so the old process keeps serving meanwhile and Warmup counts against HandoffTimeout.
+	// If it returns an error, the server does not start and the error is returned.
+	// With ExecInPlace, connections wait in the accept queue while Warmup runs.
+	Warmup func() error
+
+	// DeferExec makes ListenAndServe return nil instead of re-executing the process on restart.
+	// This gives the caller a chance to act before the process is replaced,
+	// e.g. to keep resources that are shared with the new process.
+	// The caller must check Reason and call Exec to complete the restart.
+	DeferExec bool
+
+	// ProxyProtocol makes the server read the PROXY protocol (version 1 or 2) header
+	// that load balancers such as HAProxy and AWS NLB send at the start of each connection.
+	// The client address from the header is returned by RemoteAddr of the connection
+	// and is set as http.Request.RemoteAddr. Connections without a valid header are closed.
+	ProxyProtocol bool
+
+	// AcceptErrorHandler is called when accepting a connection fails.
+	// If it returns true, the server waits a little and accepts again, otherwise it stops with the error.
+	// If nil, the server retries on temporary errors such as EMFILE (too many open files) and ECONNABORTED.
+	// It is not called for the error returned after the listener is closed, see IsClosingError.
+	AcceptErrorHandler func(error) bool
+
+	// MaxRequestBodySize is the maximum number of bytes read from a request body.
+	// Requests with a longer Content-Length are answered with 413 Request Entity Too Large.
+	// For bodies without a length, e.g. chunked uploads, reading beyond the limit fails
+	// with *http.MaxBytesError and the connection is closed after the response. Set 0 for no limit.
+	MaxRequestBodySize int64
+
+	// RecoverPanics makes the server recover panics of request handlers, log them with the stack trace
+	// and respond with 500. Otherwise, http.Server recovers the panic and closes the connection.
+	// A recovered panic does not stop the server, so the process can still drain and restart cleanly.
+	RecoverPanics bool
+
+	// OnRequest is called after each request is handled, with the status code and
+	// the number of body bytes written to the client and the time it took to handle the request.
+	// It can be used for access logs and metrics. Status is 0 for hijacked connections.
+	// If the handler panics, OnRequest is called with status 500 before the panic continues.
+	OnRequest func(r *http.Request, status int, bytes int64, dur time.Duration)
+
+	// OnListen is called with the address of each listener when the server starts serving on it,
+	// e.g. to learn the port chosen for ":0" or to register the address with service discovery.
+	OnListen func(net.Addr)
+
+	// OnAccept is called for every accepted connection before it is served, e.g. to reject clients
+	// by their address. If it returns an error, the connection is closed without being served
+	// and it is not counted in ActiveConnections. It is called in the accept loop, so it must be fast.
+	// With ProxyProtocol, c.RemoteAddr is the address of the proxy, not the client.
+	OnAccept func(c net.Conn) error
+
+	// ListenerWrapper wraps each listener before the accept loop accepts on it, e.g. to log or filter
+	// connections, or to handle a protocol in front of HTTP. The listener given to it is the one bound or
+	// inherited, and it is still the one passed to the new process on restart. The wrapper must close the
+	// listener it wraps when it is closed, and return an error matched by IsClosingError from Accept then.
+	// The connections it returns must forward SetDeadline, SetReadDeadline and SetWriteDeadline to the
+	// connections they wrap, since the connection timeouts and draining depend on them. TCP keep-alives
+	// are configured only on *net.TCPConn, and connections are reset on drain timeouts only if they have
+	// a SetLinger method like *net.TCPConn.
+	ListenerWrapper func(l net.Listener) net.Listener
+
+	// OnConnState is called when a connection changes state, in addition to http.Server.ConnState.
+	// Connections go through StateNew, StateActive and StateIdle for each request, then StateClosed or StateHijacked.
+	OnConnState func(net.Conn, http.ConnState)
+
+	// Signals to restart or shut down the server. If nil, DefaultSignals is used.
+	Signals *Signals
+
+	// DebugGoroutines makes Begin and End record their call sites.
+	// If goroutines do not finish in GoroutineGracePeriod, the number of calls at each site is logged,
+	// which helps to find a goroutine that does not call End. Finding the call sites has a cost.
+	DebugGoroutines bool
+
+	// DumpGoroutinesOnSlowShutdown writes the stacks of all goroutines when requests, hijacked connections
+	// or goroutines do not finish in their grace periods, or ShutdownDeadline is reached.
+	// Unlike DebugGoroutines, it shows where handlers are blocked too.
+	DumpGoroutinesOnSlowShutdown bool
+
+	// GoroutineDumpFile is the file the goroutine dumps are appended to. If empty, they are logged.
+	GoroutineDumpFile string
+
+	// ReapChildren makes the server wait for every child process of the process that exits, so they do not
+	// stay as zombies. Enable it when the process runs as PID 1 in a container without an init process,
+	// where orphaned processes are re-parented to it. Processes started by exec.Cmd may be reaped before
+	// Cmd.Wait is called then, and Cmd.Wait fails with ECHILD. It has no effect on Windows.
+	ReapChildren bool
+
+	// Restarter performs the process level operations of restart. If nil, goagain is used.
+	Restarter Restarter
+
+	// Clock is used to time the accept loops and the drain phases. If nil, the time package is used.
+	Clock Clock
+
+	// Log is used for logging server events. If nil, logs are written to stderr.
+	Log Logger
+
+	mu           sync.Mutex
+	stopping     chan struct{}
+	serving      bool          // set while ListenAndServe or Serve is running
+	restart      chan struct{} // receives Restart calls
+	done         chan struct{}
+	reason       Reason
+	handoff      Handoff
+	lastDrain    time.Duration
+	listeners    []net.Listener
+	onShutdown   []func()
+	goroutineWG  waitGroup
+	callSites    callSites // guarded by mu
+	hijackWG     waitGroup // counts hijacked connections until they are closed
+	activeConns  int64     // accessed atomically
+	activeReqs   int64     // accessed atomically
+	goroutines   int64     // goroutines in goroutineWG, accessed atomically
+	handingOff   int32     // set while the child forked on restart is starting, accessed atomically
+	bytesRead    int64     // accessed atomically
+	bytesWritten int64     // accessed atomically
+	conns        map[*timeoutConn]struct{}
+	connSem      chan struct{} // limits open connections to MaxConnections
+	acceptRate   *rateLimiter  // limits accepted connections to AcceptRateLimit
+
+	// reqsPerConn counts closed connections in the buckets of RequestsPerConnHistogram, accessed atomically.
+	reqsPerConn [len(requestsPerConnBounds) + 1]int64
+	reqsOfConns int64 // sum of the requests of the connections in reqsPerConn, accessed atomically
+
+	// reqsPerProto counts requests by the protocols of RequestsByProtocol, accessed atomically.
+	reqsPerProto [len(protocols) + 1]int64
+
+	// Certificate files given to ListenAndServeTLS, guarded by mu,
+	// and the certificate loaded from them.
+	certFile, keyFile string
+	cert              atomic.Value // *tls.Certificate
+
+	// handler serves the requests, it is replaced by SetHandler.
+	handler atomic.Value // handlerValue
+}
+
+// handlerValue wraps the handler because atomic.Value requires the same concrete type on every Store.
+type handlerValue struct{ http.Handler }
+
+const (
+	defaultHookGracePeriod  = 5 * time.Second
+	defaultHandoffTimeout   = 30 * time.Second
+	defaultShutdownDeadline = 5 * time.Minute
+)
+
+// NewServer returns a new Server initialized with the package-level settings.
+func NewServer() *Server {
+	return &Server{
+		RequestGracePeriod:   RequestGracePeriod,
+		GoroutineGracePeriod: GoroutineGracePeriod,
+		TCPReadTimeout:       TCPReadTimeout,
+		TCPWriteTimeout:      TCPWriteTimeout,
+		HookGracePeriod:      defaultHookGracePeriod,
+		HijackGracePeriod:    RequestGracePeriod,
+		HandoffTimeout:       defaultHandoffTimeout,
+		ShutdownDeadline:     defaultShutdownDeadline,
+	}
+}
+
+// Stopping returns a channel that will be closed when a signal is received.
+func (s *Server) Stopping() <-chan struct{} { return s.stoppingChan() }
+
+func (s *Server) stoppingChan() chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopping == nil {
+		s.stopping = make(chan struct{})
+	}
+	return s.stopping
+}
+
+// Done returns a channel that will be closed when draining is finished.
+// On restart, the process is re-executed right after the channel is closed.
+func (s *Server) Done() <-chan struct{} { return s.doneChan() }
+
+func (s *Server) doneChan() chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done == nil {
+		s.done = make(chan struct{})
+	}
+	return s.done
+}
+
+// Stop starts a graceful shutdown as if a termination signal is received.
+// It does not wait for the requests to finish. It is safe to call Stop more than once.
+func (s *Server) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopping == nil {
+		s.stopping = make(chan struct{})
+	}
+	if !isClosed(s.stopping) {
+		close(s.stopping)
+	}
+}
+
+// Shutdown starts a graceful shutdown like Stop, and waits until draining is finished, like http.Server.Shutdown.
+// If ctx is done first, it returns ctx.Err(). Draining continues in the background then, limited by the grace periods.
+// It returns nil right away if the server is not serving.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	serving := s.serving
+	s.mu.Unlock()
+	s.Stop()
+	if !serving {
+		return nil
+	}
+	select {
+	case <-s.Done():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// isClosed tells whether ch is closed without blocking. ch must not have values sent to it.
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// RegisterOnShutdown registers a function to call when the server starts shutting down.
+// Functions are called concurrently, both on shutdown and on restart,
+// after the server stops accepting new connections and before waiting for active requests.
+func (s *Server) RegisterOnShutdown(f func()) {
+	s.mu.Lock()
+	s.onShutdown = append(s.onShutdown, f)
+	s.mu.Unlock()
+}
+
+// runOnShutdown calls registered functions and waits for them up to HookGracePeriod.
+func (s *Server) runOnShutdown() {
+	s.mu.Lock()
+	hooks := s.onShutdown
+	s.mu.Unlock()
+
+	var wg waitGroup
+	wg.Add(len(hooks))
+	for _, f := range hooks {
+		go func(f func()) {
+			defer wg.Done()
+			f()
+		}(f)
+	}
+	s.waitTimeout(&wg, gracePeriod(s.HookGracePeriod), "some shutdown hooks did not finish in allowed period")
+}
+
+// ActiveConnections returns the number of open connections.
+// A connection may be idle or serve many requests during its lifetime.
+func (s *Server) ActiveConnections() int { return int(atomic.LoadInt64(&s.activeConns)) }
+
+// ActiveRequests returns the number of requests being handled.
+func (s *Server) ActiveRequests() int { return int(atomic.LoadInt64(&s.activeReqs)) }
+
+// ActiveGoroutines returns the number of goroutines tracked with Begin and End that have not ended yet.
+func (s *Server) ActiveGoroutines() int { return int(atomic.LoadInt64(&s.goroutines)) }
+
+// protocols are the protocols counted separately by RequestsByProtocol, others are counted as "other".
+var protocols = [...]string{"HTTP/1.0", "HTTP/1.1", "HTTP/2.0"}
+
+// RequestsByProtocol returns the number of requests handled by the server by their protocol, e.g. to follow
+// the adoption of HTTP/2. The keys are "HTTP/1.0", "HTTP/1.1", "HTTP/2.0" and "other", all of them are present.
+// The counters start from zero when the process is re-executed on restart.
+func (s *Server) RequestsByProtocol() map[string]int64 {
+	m := make(map[string]int64, len(s.reqsPerProto))
+	for i, p := range protocols {
+		m[p] = atomic.LoadInt64(&s.reqsPerProto[i])
+	}
+	m["other"] = atomic.LoadInt64(&s.reqsPerProto[len(protocols)])
+	return m
+}
+
+// countProtocol counts a request in RequestsByProtocol.
+func (s *Server) countProtocol(r *http.Request) {
+	i := len(protocols)
+	switch {
+	case r.ProtoMajor == 1 && r.ProtoMinor == 0:
+		i = 0
+	case r.ProtoMajor == 1 && r.ProtoMinor == 1:
+		i = 1
+	case r.ProtoMajor == 2 && r.ProtoMinor == 0:
+		i = 2
+	}
+	atomic.AddInt64(&s.reqsPerProto[i], 1)
+}
+
+// BytesRead returns the number of bytes read from the connections of the server.
+// The bytes are counted as they are on the wire, including TLS records and PROXY protocol headers.
+func (s *Server) BytesRead() int64 { return atomic.LoadInt64(&s.bytesRead) }
+
+// BytesWritten returns the number of bytes written to the connections of the server.
+// The bytes are counted as they are on the wire, including TLS records.
+func (s *Server) BytesWritten() int64 { return atomic.LoadInt64(&s.bytesWritten) }
+
+// Addrs returns the addresses of the listeners of the server.
+// It returns nil before the server starts listening.
+func (s *Server) Addrs() []net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listeners == nil {
+		return nil
+	}
+	addrs := make([]net.Addr, len(s.listeners))
+	for i, l := range s.listeners {
+		addrs[i] = l.Addr()
+	}
+	return addrs
+}
+
+// Begin must be called before spawning new goroutine from request handlers.
+func (s *Server) Begin() { s.begin(1) }
+
+// End must be called at the end of goroutines spawned from request handlers.
+// It is recommended to call End() at the beginning of a goroutine with a defer statement.
+func (s *Server) End() { s.end(1) }
+
+// ListenAndServeHandler is like ListenAndServe but serves h with a server created with default settings,
+// so a router can be served without registering it to http.DefaultServeMux.
+// If h is nil, http.DefaultServeMux is used.
+func (s *Server) ListenAndServeHandler(addr string, h http.Handler) error {
+	if h == nil {
+		h = http.DefaultServeMux
+	}
+	return s.ListenAndServe(addr, &http.Server{Addr: addr, Handler: h})
+}
+
+// ListenAndServe listens on the TCP network address addr then calls srv.Serve to handle requests on incoming connections.
+// It blocks until a signal is received and all requests are drained.
+// If addr is blank, ":http" is used.
+// If srv is blank, a server with handler http.DefaultServeMux is used.
+// srv itself is not served or modified: its settings, including Protocols and HTTP2 on Go 1.24 and later,
+// are copied to a new http.Server, so srv can be served again.
+func (s *Server) ListenAndServe(addr string, srv *http.Server) error {
+	// Set default values.
+	if addr == "" {
+		addr = ":http"
+	}
+	if srv == nil {
+		srv = &http.Server{Addr: addr, Handler: http.DefaultServeMux}
+	}
+	return s.listenAndServe([]ListenSpec{{Network: s.network(), Addr: addr}}, srv, nil)
+}
+
+// ListenAndServeMulti is similar to ListenAndServe but listens on all TCP network addresses in addrs.
+// All listeners are passed to the next process on restart and drained together on shutdown.
+// If srv is blank, a server with handler http.DefaultServeMux is used.
+func (s *Server) ListenAndServeMulti(addrs []string, srv *http.Server) error {
+	if len(addrs) == 0 {
+		return errors.New("no address to listen")
+	}
+	if srv == nil {
+		srv = &http.Server{Handler: http.DefaultServeMux}
+	}
+	specs := make([]ListenSpec, len(addrs))
+	for i, addr := range addrs {
+		specs[i] = ListenSpec{Network: s.network(), Addr: addr}
+	}
+	return s.listenAndServe(specs, srv, nil)
+}
+
+// ListenSpec is a network address to listen on.
+type ListenSpec struct {
+	// Network is the network of the listener, e.g. "tcp", "tcp4" or "unix". If empty, Server.Network is used.
+	Network string
+
+	// Addr is the address to listen on, in the form accepted by net.Listen for Network.
+	Addr string
+}
+
+// ListenAndServeSpecs is similar to ListenAndServeMulti but listens on addresses of different networks,
+// e.g. a TCP address for the service and a Unix domain socket for administration.
+// All listeners are passed to the next process on restart in the order of specs and drained together on shutdown.
+// Requests of all listeners are served by srv, which can tell them apart by http.LocalAddrContextKey.
+// If srv is blank, a server with handler http.DefaultServeMux is used.
+func (s *Server) ListenAndServeSpecs(specs []ListenSpec, srv *http.Server) error {
+	if len(specs) == 0 {
+		return errors.New("no address to listen")
+	}
+	if srv == nil {
+		srv = &http.Server{Handler: http.DefaultServeMux}
+	}
+	specs = append([]ListenSpec(nil), specs...)
+	for i := range specs {
+		if specs[i].Network == "" {
+			specs[i].Network = s.network()
+		}
+	}
+	return s.listenAndServe(specs, srv, nil)
+}
+
+// ListenAndServeUnix is similar to ListenAndServe but listens on the Unix domain socket at path.
+// The socket file is removed on shutdown, but not on restart because the next process keeps using it.
+// If srv is blank, a server with handler http.DefaultServeMux is used.
+func (s *Server) ListenAndServeUnix(path string, srv *http.Server) error {
+	if srv == nil {
+		srv = &http.Server{Handler: http.DefaultServeMux}
+	}
+	return s.listenAndServe([]ListenSpec{{Network: "unix", Addr: path}}, srv, nil)
+}
+
+// ListenAndServeTLS is similar to ListenAndServe but serves HTTPS.
+// Certificates are taken from srv.TLSConfig if present. Otherwise, certFile and keyFile must be given.
+// Other settings of srv.TLSConfig, e.g. ClientAuth and ClientCAs for mutual TLS, are used as they are.
+// Only NextProtos is filled in if it is empty, to offer HTTP/2.
+// The listener itself is plain TCP and TLS is applied per connection, so on restart the TCP listener is passed
+// to the new process, which loads the certificates again and serves TLS on it.
+// Handshakes in progress when draining starts are given up to a second to complete and send their requests,
+// which are served.
+// If addr is blank, ":https" is used.
+func (s *Server) ListenAndServeTLS(addr, certFile, keyFile string, srv *http.Server) error {
+	// Set default values.
+	if addr == "" {
+		addr = ":https"
+	}
+	if srv == nil {
+		srv = &http.Server{Addr: addr, Handler: http.DefaultServeMux}
+	}
+	config, err := s.newTLSConfig(srv, certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	return s.listenAndServe([]ListenSpec{{Network: s.network(), Addr: addr}}, srv, config)
+}
+
+// newTLSConfig returns a copy of srv.TLSConfig with certificates loaded from certFile and keyFile.
+// HTTP/2 is offered unless it is disabled with srv.TLSNextProto.
+// A certificate loaded from files is served with GetCertificate, so ReloadCertificates can replace it.
+func (s *Server) newTLSConfig(srv *http.Server, certFile, keyFile string) (*tls.Config, error) {
+	config := srv.TLSConfig
+	if config == nil {
+		config = &tls.Config{}
+	} else {
+		config = config.Clone()
+	}
+	if len(config.NextProtos) == 0 {
+		if _, ok := srv.TLSNextProto["h2"]; ok || srv.TLSNextProto == nil {
+			config.NextProtos = []string{"h2", "http/1.1"}
+		} else {
+			config.NextProtos = []string{"http/1.1"}
+		}
+	}
+
+	// A config returned from GetConfigForClient, e.g. for SNI, has its own certificates.
+	configHasCert := len(config.Certificates) > 0 || config.GetCertificate != nil || config.GetConfigForClient != nil
+	if !configHasCert || certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		s.mu.Lock()
+		s.certFile, s.keyFile = certFile, keyFile
+		s.mu.Unlock()
+		s.cert.Store(&cert)
+		config.Certificates = nil
+		config.GetCertificate = s.getCertificate
+	}
+	return config, nil
+}
+
+var errNoCertificateFiles = errors.New("httpagain: certificates are not loaded from files")
+
+// ReloadCertificates loads the certificate files given to ListenAndServeTLS again.
+// New TLS handshakes use the new certificate, existing connections are not affected.
+// If the files cannot be loaded, the current certificate is kept and the error is returned.
+// It is an error to call it if the certificates are taken from srv.TLSConfig.
+func (s *Server) ReloadCertificates() error {
+	s.mu.Lock()
+	certFile, keyFile := s.certFile, s.keyFile
+	s.mu.Unlock()
+	if certFile == "" && keyFile == "" {
+		return errNoCertificateFiles
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	s.cert.Store(&cert)
+	return nil
+}
+
+func (s *Server) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return s.cert.Load().(*tls.Certificate), nil
+}
+
+// listenAndServe serves srv on all specs until a signal is received.
+// If config is not nil, connections are served over TLS.
+func (s *Server) listenAndServe(specs []ListenSpec, srv *http.Server, config *tls.Config) error {
+	if err := s.startServing(); err != nil {
+		return err
+	}
+	defer s.stopServing()
+
+	// Inherit listeners from our parent process, get them from systemd or listen anew.
+	// The listeners are always plain TCP or Unix listeners so they can be passed to
+	// the next process on restart. TLS is handled per connection.
+	ls, inheritErr := s.restarter().Listeners()
+	if inheritErr != nil && hasHandoffPeer() {
+		// Started for a restart, but the listeners cannot be used. Listening anew fails
+		// if the parent is still listening, and the parent aborts the restart then.
+		s.logger().Printf("cannot inherit listeners: %s", inheritErr)
+	}
+	if inheritErr == nil && s.ReusePort {
+		closeListeners(ls)
+		ls = nil
+	}
+	if inheritErr != nil && !s.ReusePort {
+		var err error
+		if ls, err = systemdListeners(); err != nil {
+			return err
+		}
+	}
+	if len(ls) == 0 {
+		for _, spec := range specs {
+			l, err := s.listen(spec.Network, spec.Addr)
+			if err != nil {
+				closeListeners(ls)
+				return err
+			}
+			s.logger().Printf("listening on %s", l.Addr())
+			ls = append(ls, l)
+		}
+	} else {
+		for _, l := range ls {
+			s.logger().Printf("resuming listening on %s", l.Addr())
+		}
+		if len(ls) != len(specs) {
+			s.logger().Printf("got %d listeners for %d addresses", len(ls), len(specs))
+		}
+	}
+
+	return s.serve(ls, srv, config, inheritErr == nil, true)
+}
+
+// Serve accepts connections on l and serves them with srv until a signal is received, like ListenAndServe.
+// Since l is not created by the package, it cannot be passed to a new process:
+// restart signals are ignored and l is closed on shutdown.
+func (s *Server) Serve(l net.Listener, srv *http.Server) error {
+	if err := s.startServing(); err != nil {
+		return err
+	}
+	defer s.stopServing()
+	if srv == nil {
+		srv = &http.Server{Handler: http.DefaultServeMux}
+	}
+	return s.serve([]net.Listener{l}, srv, nil, false, false)
+}
+
+// ServeFD is like Serve but accepts connections on the listening socket fd, e.g. passed by a container runtime.
+// fd is owned by the server after the call and closed on shutdown.
+// Unlike Serve, restart is supported: the listener is passed to the new process like the ones of ListenAndServe,
+// and the new process uses it instead of fd.
+func (s *Server) ServeFD(fd uintptr, srv *http.Server) error {
+	if err := s.startServing(); err != nil {
+		return err
+	}
+	defer s.stopServing()
+	if srv == nil {
+		srv = &http.Server{Handler: http.DefaultServeMux}
+	}
+	ls, inheritErr := s.restarter().Listeners()
+	if inheritErr == nil {
+		for _, l := range ls {
+			s.logger().Printf("resuming listening on %s", l.Addr())
+		}
+	} else {
+		f := os.NewFile(fd, "fd"+strconv.FormatUint(uint64(fd), 10))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		s.logger().Printf("listening on %s", l.Addr())
+		ls = []net.Listener{l}
+	}
+	return s.serve(ls, srv, nil, inheritErr == nil, true)
+}
+
+// errAlreadyServing is returned if a Server is served more than once at the same time.
+// The package-level functions share a single Server, so they cannot be called concurrently either.
+var errAlreadyServing = errors.New("httpagain: server is already serving; use a separate Server created with NewServer for each listener group, or ListenAndServeMulti")
+
+// startServing marks the server as serving. It fails if it is already serving.
+// If a previous run has finished draining, the Stopping and Done channels are replaced with new ones,
+// so the server can be started again after it is stopped, e.g. in tests.
+// A Stop call before the first run is kept, and Serve returns right after it starts.
+func (s *Server) startServing() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.serving {
+		return errAlreadyServing
+	}
+	s.serving = true
+	if s.done != nil && isClosed(s.done) {
+		s.stopping = make(chan struct{})
+		s.done = make(chan struct{})
+		if s == defaultServer {
+			Shutdown = s.stopping
+		}
+	}
+	return nil
+}
+
+func (s *Server) stopServing() {
+	s.mu.Lock()
+	s.serving = false
+	s.mu.Unlock()
+}
+
+// serve serves srv on ls until a signal is received.
+// inherited tells if ls are passed from the parent process.
+// restartable tells if ls can be passed to a new process on restart.
+func (s *Server) serve(ls []net.Listener, srv *http.Server, config *tls.Config, inherited, restartable bool) error {
+	var acceptWG sync.WaitGroup
+	var requestWG waitGroup
+
+	if s.ReapChildren {
+		startReaper()
+	}
+
+	// Wrap original request handler to track active requests.
+	// With HTTP/2, each stream is counted as a request while
+	// the connection carrying them is counted once.
+	srv = copyServer(srv)
+	s.SetHandler(srv.Handler)
+	srv.Handler = s.wrapHandler(&requestWG)
+	if config != nil {
+		// http.Server handles HTTP/2 on TLS connections if the config offers it.
+		srv.TLSConfig = config
+	}
+	s.withServerContext(srv)
+	s.withConnContext(srv)
+	s.withConnState(srv)
+
+	s.connSem = nil
+	if s.MaxConnections > 0 {
+		s.connSem = make(chan struct{}, s.MaxConnections)
+	}
+	s.acceptRate = nil
+	if s.AcceptRateLimit > 0 {
+		s.acceptRate = newRateLimiter(s.AcceptRateLimit, s.clock())
+	}
+
+	s.mu.Lock()
+	s.listeners = ls
+	s.reason = ReasonShutdown
+	s.mu.Unlock()
+
+	// Errors from acceptLoop and srv.Serve are sent here.
+	acceptErr := make(chan error, 2*len(ls))
+
+	if s.Warmup != nil {
+		if err := s.Warmup(); err != nil {
+			closeListeners(ls)
+			return err
+		}
+	}
+
+	acceptWG.Add(len(ls))
+	for _, l := range ls {
+		if s.ListenerWrapper != nil {
+			l = s.ListenerWrapper(l)
+		}
+		go s.acceptLoop(l, srv, config, &acceptWG, acceptErr)
+	}
+	if s.OnListen != nil {
+		for _, l := range ls {
+			s.OnListen(l.Addr())
+		}
+	}
+
+	if inherited {
+		// If this is the child, send the parent SIGUSR2.  If this is the
+		// parent, send the child SIGQUIT.
+		if peer := handoffPeer(); peer != 0 {
+			s.logger().Printf("restart %d: serving, telling pid %d to drain", RestartCount(), peer)
+		}
+		if err := s.restarter().Kill(); err != nil {
+			// This process is serving and the other one drains in any case: the parent aborts the restart
+			// after HandoffTimeout, and the child may have exited already. Giving up would stop the service.
+			s.logger().Printf("restart %d: cannot tell pid %d to drain: %s", RestartCount(), handoffPeer(), err)
+		}
+		// The restart is over once the re-executed parent has told the child to drain. Forget the child,
+		// so a later SIGQUIT shuts the process down instead of being taken for the end of a handoff.
+		// The child keeps the PID of its parent until it gets the SIGQUIT of the re-executed parent.
+		if isReexecutedParent() {
+			if err := clearHandoffEnv(); err != nil {
+				s.logger().Printf("restart %d: cannot clear handoff: %s", RestartCount(), err)
+			}
+		}
+	}
+
+	// Block the main goroutine awaiting signals, a call to Stop or an error from acceptLoop.
+	sig, peerServing, err := s.wait(ls, restartable, acceptErr)
+
+	// The child sends SIGUSR2 to the parent, and the re-executed parent sends SIGQUIT to the child
+	// after they start accepting.
+	var handoff Handoff
+	if err == nil && peerServing {
+		handoff.Ready = s.clock().Now()
+	}
+
+	// Accept loops close their listeners when the server stops.
+	// On restart, keep duplicates of them to pass to the re-executed process.
+	restart := err == nil && sig == sigRestart
+	if restart {
+		dups, dupErr := dupListeners(ls)
+		if dupErr != nil {
+			restart, err = false, dupErr
+		} else {
+			s.mu.Lock()
+			s.listeners = dups
+			s.mu.Unlock()
+		}
+	}
+
+	// Signal the goroutines to stop accepting connections and wait for acceptLoop() to finish.
+	drainStart := s.clock().Now()
+	s.Stop()
+
+	// Do not let a stuck hook, request or goroutine wedge the process, whatever the grace periods are.
+	defer s.startWatchdog(restart)()
+
+	// Drain in phases, so requests are finished before the goroutines they might have spawned are waited.
+	s.enterPhase(PhaseStopAccepting)
+	acceptWG.Wait()
+	if !handoff.Ready.IsZero() {
+		handoff.StoppedAccepting = s.clock().Now()
+		s.recordHandoff(handoff)
+	}
+	if restart && s.Strategy != ExecInPlace && s.AfterChildReady != nil {
+		s.AfterChildReady()
+	}
+
+	// On shutdown, keep serving the open connections while the load balancer notices the failing health checks.
+	if err == nil && !restart && handoff.Ready.IsZero() && s.LameDuckDuration > 0 {
+		s.enterPhase(PhaseLameDuck)
+		<-s.clock().After(s.LameDuckDuration)
+	}
+
+	// Close connections after their active requests finish so clients do not reuse them while draining.
+	// Responses being written are not affected.
+	srv.SetKeepAlivesEnabled(false)
+
+	// http.Server does not serve requests read after it starts shutting down,
+	// so let the first requests already sent on new connections arrive.
+	if !s.FastShutdown {
+		s.awaitNewConns()
+	}
+
+	// Let http.Server close idle connections and send GOAWAY on HTTP/2 connections
+	// so clients stop opening new streams. It returns when draining is finished.
+	drainCtx, drainDone := context.WithCancel(context.Background())
+	defer drainDone()
+	go srv.Shutdown(drainCtx)
+
+	// Idle connections have no work to finish. Connections with an active request are closed after it.
+	s.closeIdleConns()
+
+	s.enterPhase(PhaseShutdownHooks)
+	s.runOnShutdown()
+
+	var deadline time.Time
+	if s.MaxDrainTimeout > 0 {
+		deadline = s.clock().Now().Add(s.MaxDrainTimeout)
+	}
+
+	if s.FastShutdown {
+		// Nothing is drained, requests and goroutines are killed when the process exits or is re-executed.
+		s.closeConns(false)
+		s.closeConns(true)
+	} else {
+		s.enterPhase(PhaseDrainRequests)
+		if !s.waitTimeout(&requestWG, s.phaseTimeout(gracePeriod(s.RequestGracePeriod), deadline), "some requests did not finish in allowed period, closing their connections") {
+			s.dumpGoroutines()
+			s.closeConns(false)
+		}
+		// No request is active anymore. Close the connections left idle by them,
+		// HTTP/2 connections are closed by http.Server once GOAWAY and the last responses are sent.
+		s.closeIdleConns()
+		s.awaitHTTP2Conns()
+
+		s.enterPhase(PhaseDrainHijacked)
+		if !s.waitTimeout(&s.hijackWG, s.phaseTimeout(gracePeriod(s.HijackGracePeriod), deadline), "some hijacked connections were not closed in allowed period, closing them") {
+			s.dumpGoroutines()
+			s.closeConns(true)
+		}
+
+		s.enterPhase(PhaseDrainGoroutines)
+		if !s.waitTimeout(&s.goroutineWG, s.phaseTimeout(gracePeriod(s.GoroutineGracePeriod), deadline), "some goroutines did not finish in allowed period, they will be killed") {
+			s.logCallSites()
+			s.dumpGoroutines()
+		}
+	}
+	s.recordDrain(s.clock().Now().Sub(drainStart))
+
+	if restart {
+		s.mu.Lock()
+		s.reason = ReasonRestart
+		s.mu.Unlock()
+	}
+	close(s.doneChan())
+
+	if err != nil {
+		return err
+	}
+
+	// If we received SIGUSR2, re-exec the parent process.
+	if restart && !s.DeferExec {
+		s.enterPhase(PhaseExec)
+		return s.Exec()
+	}
+	s.enterPhase(PhaseExit)
+	return nil
+}
+
+// copyServer returns a new http.Server with the settings of srv, so srv is not modified
+// and can be served again. srv is not copied as a whole because it holds the state of
+// a server that may have been served before, including locks.
+// Fields added to http.Server after Go 1.21 are copied by copyNewServerFields, which depends on the Go version.
+func copyServer(srv *http.Server) *http.Server {
+	c := &http.Server{
+		Addr:                         srv.Addr,
+		Handler:                      srv.Handler,
+		DisableGeneralOptionsHandler: srv.DisableGeneralOptionsHandler,
+		TLSConfig:                    srv.TLSConfig,
+		ReadTimeout:                  srv.ReadTimeout,
+		ReadHeaderTimeout:            srv.ReadHeaderTimeout,
+		WriteTimeout:                 srv.WriteTimeout,
+		IdleTimeout:                  srv.IdleTimeout,
+		MaxHeaderBytes:               srv.MaxHeaderBytes,
+		TLSNextProto:                 srv.TLSNextProto,
+		ConnState:                    srv.ConnState,
+		ErrorLog:                     srv.ErrorLog,
+		BaseContext:                  srv.BaseContext,
+		ConnContext:                  srv.ConnContext,
+	}
+	copyNewServerFields(c, srv)
+	return c
+}
+
+// network returns the network of TCP listeners.
+func (s *Server) network() string {
+	if s.Network == "" {
+		return "tcp"
+	}
+	return s.Network
+}
+
+// listen creates a new listener for addr.
+func (s *Server) listen(network, addr string) (net.Listener, error) {
+	var lc net.ListenConfig
+	if s.ListenConfig != nil {
+		lc = *s.ListenConfig
+	}
+	if s.ReusePort {
+		control := lc.Control
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			if control != nil {
+				if err := control(network, address, c); err != nil {
+					return err
+				}
+			}
+			return reusePortControl(network, address, c)
+		}
+	}
+	return lc.Listen(context.Background(), network, addr)
+}
+
+// closeConns resets the open connections of the server that are hijacked or not, depending on hijacked.
+// Handlers writing to them get an error and their request contexts are canceled.
+// Clients see a reset instead of a normal close, so they can tell that the response is incomplete.
+func (s *Server) closeConns(hijacked bool) {
+	s.mu.Lock()
+	conns := make([]*timeoutConn, 0, len(s.conns))
+	for c := range s.conns {
+		if c.hijacked == hijacked {
+			conns = append(conns, c)
+		}
+	}
+	s.mu.Unlock()
+	for _, c := range conns {
+		c.reset()
+	}
+}
+
+// closeIdleConns closes the connections waiting for the next request on keep-alive.
+// http.Server closes them too, but only when it polls them, which can take up to half a second.
+// New connections are not closed, since their first request may be sent already.
+// HTTP/2 connections are not closed either: they become idle when their last stream ends, possibly before
+// its response is flushed, and http.Server closes them after sending GOAWAY.
+func (s *Server) closeIdleConns() {
+	s.mu.Lock()
+	conns := make([]*timeoutConn, 0, len(s.conns))
+	for c := range s.conns {
+		if atomic.LoadInt32(&c.idle) == 1 && atomic.LoadInt32(&c.http2) == 0 {
+			conns = append(conns, c)
+		}
+	}
+	s.mu.Unlock()
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+// http2CloseGracePeriod is how long draining waits for http.Server to close HTTP/2 connections after their
+// last stream. http.Server waits up to a second for the client to close the connection after GOAWAY.
+const http2CloseGracePeriod = 1100 * time.Millisecond
+
+// awaitHTTP2Conns waits until http.Server closes the HTTP/2 connections, so the responses of their last streams
+// are flushed before the process exits or is re-executed. Those still open after http2CloseGracePeriod are closed.
+func (s *Server) awaitHTTP2Conns() {
+	const pollInterval = 10 * time.Millisecond
+	deadline := s.clock().Now().Add(http2CloseGracePeriod)
+	for {
+		var conns []*timeoutConn
+		s.mu.Lock()
+		for c := range s.conns {
+			if atomic.LoadInt32(&c.http2) == 1 {
+				conns = append(conns, c)
+			}
+		}
+		s.mu.Unlock()
+		if len(conns) == 0 {
+			return
+		}
+		if !s.clock().Now().Before(deadline) {
+			for _, c := range conns {
+				c.Close()
+			}
+			return
+		}
+		<-s.clock().After(pollInterval)
+	}
+}
+
+// newConnGracePeriod is how long draining waits for the first request of a connection after it is accepted.
+const newConnGracePeriod = time.Second
+
+// awaitNewConns waits until the connections accepted without a request yet start their first request,
+// or they are open for newConnGracePeriod. Those that have not sent anything in that period,
+// e.g. connections opened in advance by browsers, are closed, so clients retry on another server.
+// Connections that are still slow to send their request, e.g. in the TLS handshake, are closed by
+// http.Server when it shuts down.
+func (s *Server) awaitNewConns() {
+	const pollInterval = 10 * time.Millisecond
+	for {
+		now := s.clock().Now()
+		waiting := false
+		var silent []*timeoutConn
+		s.mu.Lock()
+		for c := range s.conns {
+			if atomic.LoadInt32(&c.fresh) == 0 {
+				continue
+			}
+			if now.Sub(c.accepted) < newConnGracePeriod {
+				waiting = true
+			} else if atomic.LoadInt64(&c.bytesRead) == 0 {
+				silent = append(silent, c)
+			}
+		}
+		s.mu.Unlock()
+		for _, c := range silent {
+			c.Close()
+		}
+		if !waiting {
+			return
+		}
+		<-s.clock().After(pollInterval)
+	}
+}
+
+func closeListeners(ls []net.Listener) {
+	for _, l := range ls {
+		l.Close()
+	}
+}
+
+// wait blocks until a signal is received, Stop is called or acceptLoop fails.
+// It returns after waitSignal does, so a child forked for a restart in progress is stopped by then.
+func (s *Server) wait(ls []net.Listener, restartable bool, acceptErr <-chan error) (sig syscall.Signal, peerServing bool, err error) {
+	type result struct {
+		sig         syscall.Signal
+		peerServing bool
+		err         error
+	}
+	sigC := make(chan result, 1)
+	go func() {
+		sig, peerServing, err := s.waitSignal(ls, restartable)
+		sigC <- result{sig, peerServing, err}
+	}()
+	select {
+	case r := <-sigC:
+		return r.sig, r.peerServing, r.err
+	case err := <-acceptErr:
+		s.Stop()
+		<-sigC
+		return 0, false, err
+	case <-s.Stopping():
+		<-sigC
+		return syscall.SIGTERM, false, nil
+	}
+}
+
+// waitTimeout waits for wg up to timeout. If timeout is 0, it waits indefinitely.
+// If timeout is noWait, it does not wait and succeeds only if wg is done already.
+// It returns false if the timeout is reached.
+func (s *Server) waitTimeout(wg *waitGroup, timeout time.Duration, timeoutMsg string) bool {
+	if timeout == noWait {
+		if wg.idle() {
+			return true
+		}
+		s.drainTimedOut(timeoutMsg)
+		return false
+	}
+	doneWG := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(doneWG)
+	}()
+	var timeoutChan <-chan time.Time
+	if timeout > 0 {
+		timeoutChan = s.clock().After(timeout)
+	}
+	select {
+	case <-doneWG:
+		return true
+	case <-timeoutChan:
+		s.drainTimedOut(timeoutMsg)
+		return false
+	}
+}
+
+// drainTimedOut logs msg and calls OnDrainTimeout when waitTimeout fails.
+func (s *Server) drainTimedOut(msg string) {
+	s.logger().Printf("%s", msg)
+	if s.OnDrainTimeout != nil {
+		s.OnDrainTimeout(s.ActiveRequests(), s.ActiveGoroutines())
+	}
+}
+
+// waitGroup is a sync.WaitGroup that can also tell whether it is done without waiting.
+type waitGroup struct {
+	wg sync.WaitGroup
+	n  int64 // accessed atomically
+}
+
+func (g *waitGroup) Add(delta int) {
+	atomic.AddInt64(&g.n, int64(delta))
+	g.wg.Add(delta)
+}
+
+func (g *waitGroup) Done() {
+	g.wg.Done()
+	atomic.AddInt64(&g.n, -1)
+}
+
+func (g *waitGroup) Wait() { g.wg.Wait() }
+
+// idle tells whether the counter is zero, i.e. Wait would return right away.
+func (g *waitGroup) idle() bool { return atomic.LoadInt64(&g.n) == 0 }
+
+// acceptLoop accepts connections from l and hands them to srv until the server is stopped.
+// It does no I/O on the connections: the TLS handshake and the PROXY protocol header are read
+// in the goroutine serving the connection, so a slow client does not hold up accepting others.
+func (s *Server) acceptLoop(l net.Listener, srv *http.Server, config *tls.Config, acceptWG *sync.WaitGroup, errC chan<- error) {
+	defer acceptWG.Done()
+	stopping := s.Stopping()
+
+	// srv serves connections after the accept loop returns, until they are closed.
+	cl := newConnListener(l.Addr())
+	defer cl.Close()
+	go func() {
+		defer cl.Close()
+		if err := srv.Serve(cl); !IsClosingError(err) && !errors.Is(err, http.ErrServerClosed) {
+			errC <- err
+		}
+	}()
+
+	sem := s.connSem
+	rate := s.acceptRate
+	release := func() {
+		if sem != nil {
+			<-sem
+		}
+	}
+
+	// Accept blocks until the listener is closed when the server stops.
+	// Closing removes the Unix socket file if we have created it, unless it is kept for restart.
+	// Inherited sockets are not removed because the other process may still be using it.
+	// The listener is also closed when the loop returns on an error, before the server returns.
+	defer l.Close()
+	go func() {
+		<-stopping
+		l.Close()
+	}()
+
+	var delay time.Duration // how long to sleep on accept failure
+	for {
+
+		// Wait for a free slot if the connection limit is reached.
+		if sem != nil {
+			select {
+			case sem <- struct{}{}:
+			case <-stopping:
+				return
+			}
+		}
+
+		// Wait if connections are accepted faster than the limit.
+		if rate != nil && !rate.wait(stopping) {
+			release()
+			return
+		}
+
+		c, err := l.Accept()
+		if err != nil {
+			release()
+			if IsClosingError(err) {
+				return
+			}
+			// Any error is expected after the listener is closed on shutdown.
+			select {
+			case <-stopping:
+				return
+			default:
+			}
+			// While the child forked on restart is starting, keep retrying instead of shutting down,
+			// the listener is passed to the child and the restart completes without this accept loop.
+			// If the restart is aborted, the error is handled as usual on the next failure.
+			if !s.retryAccept(err) && atomic.LoadInt32(&s.handingOff) == 0 {
+				errC <- err
+				return
+			}
+			// Back off like http.Server does, so the loop does not spin while the error lasts.
+			if delay == 0 {
+				delay = minAcceptRetryDelay
+			} else if delay *= 2; delay > maxAcceptRetryDelay {
+				delay = maxAcceptRetryDelay
+			}
+			wait := jitter(delay)
+			s.logger().Printf("accept error: %v; retrying in %v", err, wait)
+			select {
+			case <-s.clock().After(wait):
+			case <-stopping:
+				return
+			}
+			continue
+		}
+		delay = 0
+
+		if s.OnAccept != nil {
+			if err := s.OnAccept(c); err != nil {
+				c.Close()
+				release()
+				continue
+			}
+		}
+
+		s.setKeepAlive(c)
+
+		// The slot is released when the connection is closed.
+		var conn net.Conn = s.newConn(c, sem, srv)
+		if s.ProxyProtocol {
+			conn = newProxyConn(conn)
+		}
+		if config != nil {
+			// Timeouts apply to the TLS handshake too.
+			conn = tls.Server(conn, config)
+		}
+
+		// Server will spawn a goroutine for the connection.
+		if !cl.push(conn) {
+			conn.Close()
+			return
+		}
+	}
+}
+
+// setKeepAlive configures TCP keep-alives of c with TCPKeepAlivePeriod.
+func (s *Server) setKeepAlive(c net.Conn) {
+	tc, ok := c.(*net.TCPConn)
+	if !ok || s.TCPKeepAlivePeriod == 0 {
+		return
+	}
+	if s.TCPKeepAlivePeriod < 0 {
+		tc.SetKeepAlive(false)
+		return
+	}
+	tc.SetKeepAlive(true)
+	tc.SetKeepAlivePeriod(s.TCPKeepAlivePeriod)
+}
+
+const (
+	minAcceptRetryDelay = 5 * time.Millisecond
+	maxAcceptRetryDelay = time.Second
+)
+
+// jitter returns a random duration between d/2 and d, so that the accept loops of
+// many listeners or processes failing at the same time do not retry in lockstep.
+func jitter(d time.Duration) time.Duration {
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// retryAccept reports whether the accept loop should continue after err.
+func (s *Server) retryAccept(err error) bool {
+	if s.AcceptErrorHandler != nil {
+		return s.AcceptErrorHandler(err)
+	}
+	return isTemporaryAcceptError(err)
+}
+
+// isTemporaryAcceptError reports whether err is likely to go away without intervention,
+// e.g. when file descriptors are exhausted or the client resets the connection while it is in the queue.
+// Errors are matched with errors.Is and errors.As, so errors wrapped by custom listeners are recognized too.
+func isTemporaryAcceptError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	for _, errno := range []syscall.Errno{syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM, syscall.ECONNABORTED, syscall.ECONNRESET} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// withConnState makes srv report connection state changes to the connections of the server and OnConnState.
+func (s *Server) withConnState(srv *http.Server) {
+	connState := srv.ConnState
+	srv.ConnState = func(c net.Conn, state http.ConnState) {
+		if tc := connOf(c); tc != nil {
+			tc.setState(c, state)
+		}
+		if s.OnConnState != nil {
+			s.OnConnState(c, state)
+		}
+		if connState != nil {
+			connState(c, state)
+		}
+	}
+}
+
+// SetHandler replaces the handler of the server without a restart.
+// Subsequent requests are served by h while in-flight requests finish on the previous handler.
+// It has effect while serving, ListenAndServe starts with the handler of srv.
+// If h is nil, http.DefaultServeMux is used.
+func (s *Server) SetHandler(h http.Handler) {
+	if h == nil {
+		h = http.DefaultServeMux
+	}
+	if s.MaxRequestBodySize > 0 {
+		h = limitBody(h, s.MaxRequestBodySize)
+	}
+	s.handler.Store(handlerValue{h})
+}
+
+// wrapHandler counts the requests while they are being handled by the handler set with SetHandler.
+// Requests are counted in the handler rather than per connection,
+// because a keep-alive connection may serve many requests.
+// If the connection is hijacked, the request is not counted anymore, the connection is counted in hijackWG instead.
+func (s *Server) wrapHandler(wg *waitGroup) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := s.handler.Load().(handlerValue).Handler
+		wg.Add(1)
+		if n := atomic.AddInt64(&s.activeReqs, 1); s.MaxConcurrentRequests > 0 && n > int64(s.MaxConcurrentRequests) {
+			h = http.HandlerFunc(s.overloaded)
+		}
+		var once sync.Once
+		done := func() {
+			once.Do(func() {
+				atomic.AddInt64(&s.activeReqs, -1)
+				wg.Done()
+			})
+		}
+		defer done()
+		s.countProtocol(r)
+		if tc := connFromContext(r.Context()); tc != nil {
+			tc.headerRead()
+			atomic.AddInt64(&tc.requests, 1)
+			// HTTP/2 connections cannot be hijacked and serve many requests at once.
+			if r.ProtoMajor == 1 {
+				tc.requestDone = done
+				defer func() { tc.requestDone = nil }()
+			}
+		}
+		if s.OnRequest == nil && !s.RecoverPanics {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w, rw := newResponseWriter(w)
+		start := time.Now()
+		panicked := true
+		if s.OnRequest != nil {
+			defer func() {
+				// The panic continues after the hook is called, unless it is recovered.
+				status := rw.Status()
+				if panicked {
+					status = http.StatusInternalServerError
+				}
+				s.OnRequest(r, status, rw.bytes, time.Since(start))
+			}()
+		}
+		if s.RecoverPanics {
+			defer s.recoverPanic(rw, r)
+		}
+		h.ServeHTTP(w, r)
+		panicked = false
+	})
+}
+
+// overloaded responds to a request rejected by MaxConcurrentRequests.
+func (s *Server) overloaded(w http.ResponseWriter, r *http.Request) {
+	if s.OverloadRetryAfter > 0 {
+		secs := (s.OverloadRetryAfter + time.Second - 1) / time.Second
+		w.Header().Set("Retry-After", strconv.FormatInt(int64(secs), 10))
+	}
+	body := s.OverloadBody
+	if body == "" {
+		body = http.StatusText(http.StatusServiceUnavailable)
+	}
+	http.Error(w, body, http.StatusServiceUnavailable)
+}
+
+// limitBody makes h read at most n bytes from request bodies.
+// Requests declaring a longer body are answered with 413 without calling h.
+// Reading more than n bytes of a body with unknown length fails with *http.MaxBytesError.
+func limitBody(h http.Handler, n int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > n {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, n)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// recoverPanic recovers a panic of the handler writing to w and responds with 500.
+// If the response is already started, the connection is closed because the response cannot be completed.
+func (s *Server) recoverPanic(w *responseWriter, r *http.Request) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	if v == http.ErrAbortHandler {
+		panic(v)
+	}
+	s.logger().Printf("panic serving %s %s: %v\n%s", r.Method, r.URL, v, debug.Stack())
+	if w.status != 0 || w.hijacked {
+		// http.Server closes the connection without logging.
+		panic(http.ErrAbortHandler)
+	}
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
@@ -0,0 +1,8 @@
+//go:build !go1.24
+
+package httpagain
+
+import "net/http"
+
+// copyNewServerFields copies the fields of srv added after Go 1.21 to c. There are none before Go 1.24.
+func copyNewServerFields(c, srv *http.Server) {}
@@ -0,0 +1,11 @@
+//go:build go1.24 && !go1.27
+
+package httpagain
+
+import "net/http"
+
+// copyNewServerFields copies the fields of srv added after Go 1.21 to c.
+func copyNewServerFields(c, srv *http.Server) {
+	c.HTTP2 = srv.HTTP2
+	c.Protocols = srv.Protocols
+}
@@ -0,0 +1,746 @@
+package httpagain
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// newTestServer returns a server that does not log and never exits the process.
+func newTestServer() *Server {
+	s := NewServer()
+	s.Log = log.New(io.Discard, "", 0)
+	s.RequestGracePeriod = time.Second
+	s.GoroutineGracePeriod = time.Second
+	s.HijackGracePeriod = time.Second
+	s.ShutdownDeadline = 0
+	return s
+}
+
+// okHandler responds with "ok" to every request.
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "ok") })
+
+// pipeListener is a net.Listener that is not a *net.TCPListener.
+// Accept returns the server ends of the connections created by Dial with net.Pipe.
+type pipeListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+// Dial returns the client end of a new connection, after the server end is accepted.
+func (l *pipeListener) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	c, sc := net.Pipe()
+	select {
+	case l.conns <- sc:
+		return c, nil
+	case <-l.done:
+	case <-ctx.Done():
+	}
+	c.Close()
+	sc.Close()
+	return nil, net.ErrClosed
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr { return pipeAddr{} }
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+// client returns an HTTP client connecting to l.
+func (l *pipeListener) client() *http.Client {
+	return &http.Client{Transport: &http.Transport{DialContext: l.Dial}}
+}
+
+// get requests url with c and returns the body of the response.
+func get(t *testing.T, c *http.Client, url string) string {
+	t.Helper()
+	resp, err := c.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// serve runs s.Serve in a goroutine and returns the channel its error is sent to.
+func serve(s *Server, l net.Listener, h http.Handler) <-chan error {
+	errC := make(chan error, 1)
+	go func() { errC <- s.Serve(l, &http.Server{Handler: h}) }()
+	return errC
+}
+
+// waitErr returns the error sent to errC, failing the test if it takes too long.
+func waitErr(t testing.TB, errC <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-errC:
+		return err
+	case <-time.After(10 * time.Second):
+		t.Fatal("server did not return")
+		return nil
+	}
+}
+
+func TestServeCustomListener(t *testing.T) {
+	s := newTestServer()
+	l := newPipeListener()
+	errC := serve(s, l, okHandler)
+
+	if body := get(t, l.client(), "http://pipe/"); body != "ok" {
+		t.Errorf("body = %q, want %q", body, "ok")
+	}
+
+	s.Stop()
+	if err := waitErr(t, errC); err != nil {
+		t.Fatal(err)
+	}
+	if !isClosed(l.done) {
+		t.Error("listener is not closed on shutdown")
+	}
+}
+
+func TestOnConnStateKeepAlive(t *testing.T) {
+	s := newTestServer()
+	var mu sync.Mutex
+	var states []http.ConnState
+	conns := make(map[net.Conn]bool)
+	closed := make(chan struct{})
+	s.OnConnState = func(c net.Conn, state http.ConnState) {
+		mu.Lock()
+		defer mu.Unlock()
+		states = append(states, state)
+		conns[c] = true
+		if state == http.StateClosed {
+			close(closed)
+		}
+	}
+	l := newPipeListener()
+	errC := serve(s, l, okHandler)
+
+	c := l.client()
+	for i := 0; i < 3; i++ {
+		get(t, c, "http://pipe/")
+	}
+	c.CloseIdleConnections()
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("connection is not closed")
+	}
+
+	s.Stop()
+	if err := waitErr(t, errC); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	want := []http.ConnState{
+		http.StateNew,
+		http.StateActive, http.StateIdle,
+		http.StateActive, http.StateIdle,
+		http.StateActive, http.StateIdle,
+		http.StateClosed,
+	}
+	if len(conns) != 1 {
+		t.Errorf("requests are served on %d connections, want 1", len(conns))
+	}
+	if len(states) != len(want) {
+		t.Fatalf("states = %v, want %v", states, want)
+	}
+	for i := range want {
+		if states[i] != want[i] {
+			t.Fatalf("states = %v, want %v", states, want)
+		}
+	}
+}
+
+func TestServeAgainAfterStop(t *testing.T) {
+	s := newTestServer()
+	for i := 0; i < 2; i++ {
+		l := newPipeListener()
+		errC := serve(s, l, okHandler)
+
+		// The request is served only if the server did not see the Stop of the previous run.
+		if body := get(t, l.client(), "http://pipe/"); body != "ok" {
+			t.Fatalf("run %d: body = %q, want %q", i, body, "ok")
+		}
+		stopping, done := s.stoppingChan(), s.doneChan()
+		if isClosed(stopping) || isClosed(done) {
+			t.Fatalf("run %d: server is stopped before Stop", i)
+		}
+
+		s.Stop()
+		if err := waitErr(t, errC); err != nil {
+			t.Fatalf("run %d: %s", i, err)
+		}
+		if !isClosed(stopping) || !isClosed(done) {
+			t.Fatalf("run %d: server is not stopped after Serve returns", i)
+		}
+	}
+}
+
+// scriptedListener returns the connections and errors in results from Accept in order,
+// then blocks until it is closed.
+type scriptedListener struct {
+	mu      sync.Mutex
+	results []acceptResult
+	done    chan struct{}
+	once    sync.Once
+}
+
+type acceptResult struct {
+	c   net.Conn
+	err error
+}
+
+func newScriptedListener(results ...acceptResult) *scriptedListener {
+	return &scriptedListener{results: results, done: make(chan struct{})}
+}
+
+func (l *scriptedListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	if len(l.results) > 0 {
+		r := l.results[0]
+		l.results = l.results[1:]
+		l.mu.Unlock()
+		return r.c, r.err
+	}
+	l.mu.Unlock()
+	<-l.done
+	return nil, net.ErrClosed
+}
+
+func (l *scriptedListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *scriptedListener) Addr() net.Addr { return pipeAddr{} }
+
+// timeoutError is a net.Error that is not a *net.OpError.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestIsTemporaryAcceptError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{syscall.EMFILE, true},
+		{fmt.Errorf("wrapped: %w", syscall.ECONNABORTED), true},
+		{&net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.ENFILE)}, true},
+		{timeoutError{}, true},
+		{errors.New("not a net.Error"), false},
+		{&net.OpError{Op: "accept", Net: "tcp", Err: errors.New("unknown")}, false},
+	}
+	for _, test := range tests {
+		if got := isTemporaryAcceptError(test.err); got != test.want {
+			t.Errorf("isTemporaryAcceptError(%#v) = %t, want %t", test.err, got, test.want)
+		}
+	}
+}
+
+func TestAcceptNonOpError(t *testing.T) {
+	s := newTestServer()
+	permanent := errors.New("permanent")
+	l := newScriptedListener(
+		acceptResult{err: fmt.Errorf("wrapped: %w", syscall.EMFILE)},
+		acceptResult{err: timeoutError{}},
+		acceptResult{err: permanent},
+	)
+	errC := serve(s, l, okHandler)
+
+	// The temporary errors are retried, the next one stops the server.
+	if err := waitErr(t, errC); err != permanent {
+		t.Fatalf("Serve() = %v, want %v", err, permanent)
+	}
+	if !isClosed(l.done) {
+		t.Error("listener is not closed")
+	}
+}
+
+// fakeClock records the durations waited with After, which returns right away.
+type fakeClock struct {
+	mu    sync.Mutex
+	waits []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time { return time.Now() }
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	c.waits = append(c.waits, d)
+	c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	ch <- time.Now()
+	return ch
+}
+
+func TestAcceptBackoff(t *testing.T) {
+	s := newTestServer()
+	clock := &fakeClock{}
+	s.Clock = clock
+	temporary := fmt.Errorf("accept: %w", syscall.EMFILE)
+	permanent := errors.New("permanent")
+	// The client hangs up, so draining does not wait for a request on the connection.
+	client, conn := net.Pipe()
+	client.Close()
+	l := newScriptedListener(
+		acceptResult{err: temporary},
+		acceptResult{err: temporary},
+		acceptResult{err: temporary},
+		acceptResult{err: temporary},
+		acceptResult{c: conn},
+		acceptResult{err: temporary},
+		acceptResult{err: temporary},
+		acceptResult{err: permanent},
+	)
+	errC := serve(s, l, okHandler)
+	if err := waitErr(t, errC); err != permanent {
+		t.Fatalf("Serve() = %v, want %v", err, permanent)
+	}
+
+	// The delay doubles on each error and starts over after a connection is accepted.
+	// The waits of draining follow the ones of the accept loop.
+	ms := time.Millisecond
+	want := []time.Duration{5 * ms, 10 * ms, 20 * ms, 40 * ms, 5 * ms, 10 * ms}
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	if len(clock.waits) < len(want) {
+		t.Fatalf("waits = %v, want %d of them", clock.waits, len(want))
+	}
+	for i, max := range want {
+		if d := clock.waits[i]; d < max/2 || d > max {
+			t.Errorf("wait %d is %s, want between %s and %s", i, d, max/2, max)
+		}
+	}
+}
+
+func TestAcceptBackoffLimit(t *testing.T) {
+	s := newTestServer()
+	clock := &fakeClock{}
+	s.Clock = clock
+	results := make([]acceptResult, 12)
+	for i := range results {
+		results[i].err = syscall.ECONNABORTED
+	}
+	permanent := errors.New("permanent")
+	l := newScriptedListener(append(results, acceptResult{err: permanent})...)
+	errC := serve(s, l, okHandler)
+	if err := waitErr(t, errC); err != permanent {
+		t.Fatalf("Serve() = %v, want %v", err, permanent)
+	}
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	for i, d := range clock.waits[:len(results)] {
+		if d > maxAcceptRetryDelay {
+			t.Errorf("wait %d is %s, more than %s", i, d, maxAcceptRetryDelay)
+		}
+	}
+	if d := clock.waits[len(results)-1]; d < maxAcceptRetryDelay/2 {
+		t.Errorf("last wait is %s, want at least %s", d, maxAcceptRetryDelay/2)
+	}
+}
+
+func TestCopyServer(t *testing.T) {
+	// Set every exported field, so the test fails when Go adds a field that is not copied.
+	srv := &http.Server{}
+	v := reflect.ValueOf(srv).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		if !v.Type().Field(i).IsExported() {
+			continue
+		}
+		switch f.Kind() {
+		case reflect.String:
+			f.SetString("x")
+		case reflect.Bool:
+			f.SetBool(true)
+		case reflect.Int, reflect.Int64:
+			f.SetInt(1)
+		case reflect.Ptr:
+			f.Set(reflect.New(f.Type().Elem()))
+		case reflect.Map:
+			f.Set(reflect.MakeMap(f.Type()))
+		case reflect.Func:
+			f.Set(reflect.MakeFunc(f.Type(), func([]reflect.Value) []reflect.Value { return nil }))
+		case reflect.Interface:
+			f.Set(reflect.ValueOf(okHandler))
+		default:
+			t.Fatalf("cannot set field %s of kind %s", v.Type().Field(i).Name, f.Kind())
+		}
+	}
+
+	c := reflect.ValueOf(copyServer(srv)).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		if !v.Type().Field(i).IsExported() {
+			continue
+		}
+		want, got := v.Field(i), c.Field(i)
+		var equal bool
+		switch want.Kind() {
+		case reflect.Ptr, reflect.Map, reflect.Func:
+			equal = want.Pointer() == got.Pointer()
+		case reflect.Interface:
+			equal = got.Elem().Pointer() == want.Elem().Pointer()
+		default:
+			equal = want.Interface() == got.Interface()
+		}
+		if !equal {
+			t.Errorf("field %s is not copied", name)
+		}
+	}
+}
+
+func TestLoadDefaultServer(t *testing.T) {
+	defer func(d time.Duration) { RequestGracePeriod = d }(RequestGracePeriod)
+	RequestGracePeriod = 3 * time.Second
+	s := loadDefaultServer()
+	if s.RequestGracePeriod != RequestGracePeriod || s.HijackGracePeriod != RequestGracePeriod {
+		t.Errorf("RequestGracePeriod = %s, HijackGracePeriod = %s, want %s for both", s.RequestGracePeriod, s.HijackGracePeriod, RequestGracePeriod)
+	}
+}
+
+// manualClock is a Clock that only moves when it is advanced.
+// The durations given to After are sent to added, so tests can wait for a timer to be set.
+type manualClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []manualTimer
+	added  chan time.Duration
+}
+
+type manualTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newManualClock() *manualClock {
+	return &manualClock{now: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC), added: make(chan time.Duration, 100)}
+}
+
+func (c *manualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *manualClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+	} else {
+		c.timers = append(c.timers, manualTimer{at: c.now.Add(d), c: ch})
+	}
+	select {
+	case c.added <- d:
+	default:
+	}
+	return ch
+}
+
+// Advance moves the clock by d and fires the timers that expire.
+func (c *manualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	timers := c.timers[:0]
+	for _, t := range c.timers {
+		if t.at.After(c.now) {
+			timers = append(timers, t)
+			continue
+		}
+		t.c <- c.now
+	}
+	c.timers = timers
+}
+
+// waitTimer waits until a timer of d is set.
+func (c *manualClock) waitTimer(t *testing.T, d time.Duration) {
+	t.Helper()
+	for {
+		select {
+		case got := <-c.added:
+			if got == d {
+				return
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timer of %s is not set", d)
+		}
+	}
+}
+
+// clockLog records the lines logged to it with the time of clock.
+type clockLog struct {
+	clock *manualClock
+	mu    sync.Mutex
+	lines []string
+	times []time.Time
+}
+
+func (l *clockLog) Write(p []byte) (int, error) {
+	now := l.clock.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, strings.TrimSuffix(string(p), "\n"))
+	l.times = append(l.times, now)
+	return len(p), nil
+}
+
+// find returns the time line is logged at.
+func (l *clockLog) find(line string) (time.Time, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := range l.lines {
+		if l.lines[i] == line {
+			return l.times[i], true
+		}
+	}
+	return time.Time{}, false
+}
+
+func TestRequestGracePeriodClock(t *testing.T) {
+	const grace = 7 * time.Second
+	const msg = "some requests did not finish in allowed period, closing their connections"
+	clock := newManualClock()
+	logs := &clockLog{clock: clock}
+	s := newTestServer()
+	s.Clock = clock
+	s.Log = log.New(logs, "", 0)
+	s.RequestGracePeriod = grace
+	var mu sync.Mutex
+	var phases []string
+	s.OnPhase = func(phase string) {
+		mu.Lock()
+		phases = append(phases, phase)
+		mu.Unlock()
+	}
+	timedOut := make(chan struct{})
+	s.OnDrainTimeout = func(int, int) { close(timedOut) }
+
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	l := newPipeListener()
+	errC := serve(s, l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	go func() {
+		if resp, err := l.client().Get("http://pipe/"); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-started
+
+	s.Stop()
+	clock.waitTimer(t, grace)
+	start := clock.Now()
+	clock.Advance(grace - time.Nanosecond)
+	if _, ok := logs.find(msg); ok {
+		t.Fatal("timeout is logged before the grace period elapses")
+	}
+	clock.Advance(time.Nanosecond)
+	select {
+	case <-timedOut:
+	case <-time.After(10 * time.Second):
+		t.Fatal("request grace period did not time out")
+	}
+	if err := waitErr(t, errC); err != nil {
+		t.Fatal(err)
+	}
+
+	if at, ok := logs.find(msg); !ok || !at.Equal(start.Add(grace)) {
+		t.Errorf("timeout is logged at %s (%t), want %s after draining starts", at.Sub(start), ok, grace)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{PhaseStopAccepting, PhaseShutdownHooks, PhaseDrainRequests, PhaseDrainHijacked, PhaseDrainGoroutines, PhaseExit}
+	if fmt.Sprint(phases) != fmt.Sprint(want) {
+		t.Errorf("phases = %q, want %q", phases, want)
+	}
+}
+
+// testCertificate returns the certificate of httptest servers and a pool that trusts it.
+func testCertificate() (tls.Certificate, *x509.CertPool) {
+	ts := httptest.NewUnstartedServer(nil)
+	ts.StartTLS()
+	defer ts.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+	return ts.TLS.Certificates[0], roots
+}
+
+func TestHTTP2ShutdownMidStream(t *testing.T) {
+	const streams = 3
+	cert, roots := testCertificate()
+	s := newTestServer()
+	s.RequestGracePeriod = 10 * time.Second
+	addrC := make(chan net.Addr, 1)
+	s.OnListen = func(addr net.Addr) { addrC <- addr }
+	draining := make(chan struct{})
+	s.OnPhase = func(phase string) {
+		if phase == PhaseDrainRequests {
+			close(draining)
+		}
+	}
+	started, release := make(chan struct{}, streams), make(chan struct{})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			started <- struct{}{}
+			<-release
+		}
+		io.WriteString(w, "ok")
+	})
+	srv := &http.Server{Handler: h, TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}}}
+	errC := make(chan error, 1)
+	go func() { errC <- s.ListenAndServeTLS("127.0.0.1:0", "", "", srv) }()
+	var addr net.Addr
+	select {
+	case addr = <-addrC:
+	case err := <-errC:
+		t.Fatal(err)
+	}
+
+	c := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}, ForceAttemptHTTP2: true}}
+	defer c.CloseIdleConnections()
+	// Open the connection first, so the streams do not dial their own ones.
+	url := "https://" + addr.String()
+	get(t, c, url+"/")
+	type result struct {
+		proto int
+		body  string
+		err   error
+	}
+	results := make(chan result, streams)
+	for i := 0; i < streams; i++ {
+		go func() {
+			resp, err := c.Get(url + "/slow")
+			if err != nil {
+				results <- result{err: err}
+				return
+			}
+			defer resp.Body.Close()
+			b, err := io.ReadAll(resp.Body)
+			results <- result{resp.ProtoMajor, string(b), err}
+		}()
+	}
+	for i := 0; i < streams; i++ {
+		<-started
+	}
+	// The streams share a connection, which is counted once. Each stream is a request.
+	if n := s.ActiveConnections(); n != 1 {
+		t.Errorf("ActiveConnections() = %d, want 1", n)
+	}
+	if n := s.ActiveRequests(); n != streams {
+		t.Errorf("ActiveRequests() = %d, want %d", n, streams)
+	}
+
+	// Draining waits for the streams in progress.
+	s.Stop()
+	<-draining
+	select {
+	case err := <-errC:
+		t.Fatalf("server returned with active streams: %v", err)
+	default:
+	}
+	close(release)
+	for i := 0; i < streams; i++ {
+		r := <-results
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		if r.proto != 2 || r.body != "ok" {
+			t.Errorf("response is HTTP/%d with body %q, want HTTP/2 with %q", r.proto, r.body, "ok")
+		}
+	}
+	if err := waitErr(t, errC); err != nil {
+		t.Fatal(err)
+	}
+	// The connection is closed by http.Server after GOAWAY, before the process would exit.
+	if n := s.ActiveConnections(); n != 0 {
+		t.Errorf("ActiveConnections() = %d after draining, want 0", n)
+	}
+}
+
+func TestListenTCP4(t *testing.T) {
+	s := newTestServer()
+	s.Network = "tcp4"
+	addrC := make(chan net.Addr, 1)
+	s.OnListen = func(addr net.Addr) { addrC <- addr }
+	errC := make(chan error, 1)
+	go func() { errC <- s.ListenAndServe("127.0.0.1:0", &http.Server{Handler: okHandler}) }()
+	var addr net.Addr
+	select {
+	case addr = <-addrC:
+	case err := <-errC:
+		t.Fatal(err)
+	}
+
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok || tcpAddr.IP.To4() == nil {
+		t.Fatalf("listening on %v, want an IPv4 address", addr)
+	}
+	c := &http.Client{Transport: &http.Transport{}}
+	if body := get(t, c, "http://"+addr.String()+"/"); body != "ok" {
+		t.Errorf("body = %q, want %q", body, "ok")
+	}
+	c.CloseIdleConnections()
+	if conn, err := net.Dial("tcp6", net.JoinHostPort("::1", strconv.Itoa(tcpAddr.Port))); err == nil {
+		conn.Close()
+		t.Error("IPv6 connection is accepted")
+	}
+
+	s.Stop()
+	if err := waitErr(t, errC); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,437 @@
+//go:build !windows
+
+package httpagain
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestServeFD(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	f, err := l.(*net.TCPListener).File()
+	l.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The server owns the descriptor given to it, so give it one that f does not close.
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestServer()
+	errC := make(chan error, 1)
+	go func() { errC <- s.ServeFD(uintptr(fd), &http.Server{Handler: okHandler}) }()
+
+	c := &http.Client{Transport: &http.Transport{}}
+	if body := get(t, c, "http://"+addr+"/"); body != "ok" {
+		t.Errorf("body = %q, want %q", body, "ok")
+	}
+	c.CloseIdleConnections()
+
+	s.Stop()
+	if err := waitErr(t, errC); err != nil {
+		t.Fatal(err)
+	}
+	// Connections are refused once no descriptor of the socket is open.
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Fatal("listening socket is not closed on shutdown")
+	}
+}
+
+// fakeRestarter simulates a restart in the test process. The child started by ForkExec
+// is ready right away, and the listeners passed to Exec are recorded.
+// The hooks replace these to simulate slower processes, and onKill is called by Kill if set.
+type fakeRestarter struct {
+	ls       []net.Listener // returned from Listeners
+	forkExec func(ls []net.Listener) error
+	exec     func(ls []net.Listener) error
+	onKill   func()
+
+	mu         sync.Mutex
+	c          chan<- os.Signal
+	execLs     []net.Listener
+	killed     chan struct{}
+	notified   chan struct{}
+	notifyOnce sync.Once
+}
+
+func newFakeRestarter(ls ...net.Listener) *fakeRestarter {
+	return &fakeRestarter{ls: ls, killed: make(chan struct{}), notified: make(chan struct{})}
+}
+
+func (r *fakeRestarter) Listeners() ([]net.Listener, error) { return r.ls, nil }
+
+func (r *fakeRestarter) Kill() error {
+	close(r.killed)
+	if r.onKill != nil {
+		r.onKill()
+	}
+	return nil
+}
+
+func (r *fakeRestarter) Notify(c chan<- os.Signal, sig ...os.Signal) {
+	r.mu.Lock()
+	r.c = c
+	r.mu.Unlock()
+	r.notifyOnce.Do(func() { close(r.notified) })
+}
+
+// signal sends sig to the server as if the process got it.
+func (r *fakeRestarter) signal(t *testing.T, sig os.Signal) {
+	t.Helper()
+	select {
+	case <-r.notified:
+	case <-time.After(10 * time.Second):
+		t.Fatal("server does not wait for signals")
+	}
+	r.send(sig)
+}
+
+// send sends sig to the server, which must be waiting for signals already.
+func (r *fakeRestarter) send(sig os.Signal) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.c <- sig
+}
+
+func (r *fakeRestarter) StopNotify(c chan<- os.Signal) {}
+
+func (r *fakeRestarter) ForkExec(ls []net.Listener) error {
+	if r.forkExec != nil {
+		return r.forkExec(ls)
+	}
+	r.send(sigRestart)
+	return nil
+}
+
+func (r *fakeRestarter) Abort() error { return nil }
+
+func (r *fakeRestarter) Exec(ls []net.Listener) error {
+	r.mu.Lock()
+	r.execLs = ls
+	r.mu.Unlock()
+	if r.exec != nil {
+		return r.exec(ls)
+	}
+	return nil
+}
+
+// waitServing waits until the server given r tells the other process of the restart that it is serving.
+func (r *fakeRestarter) waitServing(t testing.TB, errC <-chan error) {
+	t.Helper()
+	select {
+	case <-r.killed:
+	case err := <-errC:
+		t.Fatalf("server returned before serving: %v", err)
+	}
+}
+
+// execListeners returns the listeners passed to Exec.
+func (r *fakeRestarter) execListeners() []net.Listener {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.execLs
+}
+
+// keepRestartEnv restores the variables that a restart sets for the new process when t finishes.
+func keepRestartEnv(t testing.TB) {
+	for _, k := range []string{envRestarts, envLastRestart, envLastDrain} {
+		t.Setenv(k, os.Getenv(k))
+	}
+}
+
+func TestRestartTLS(t *testing.T) {
+	keepRestartEnv(t)
+	cert, roots := testCertificate()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "https://" + l.Addr().String() + "/"
+	r := newFakeRestarter(l)
+
+	// serveTLS serves HTTPS like a process started by a restart, on the listeners of r.
+	serveTLS := func(r *fakeRestarter) (*Server, <-chan error) {
+		s := newTestServer()
+		s.Restarter = r
+		errC := make(chan error, 1)
+		srv := &http.Server{Handler: okHandler, TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}}}
+		go func() { errC <- s.ListenAndServeTLS("127.0.0.1:0", "", "", srv) }()
+		r.waitServing(t, errC)
+		return s, errC
+	}
+	getTLS := func() {
+		t.Helper()
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+		defer c.CloseIdleConnections()
+		resp, err := c.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.TLS == nil || string(b) != "ok" {
+			t.Fatalf("TLS = %v, body = %q, want TLS and %q", resp.TLS != nil, b, "ok")
+		}
+	}
+
+	s, errC := serveTLS(r)
+	getTLS()
+	s.Restart()
+	if err := waitErr(t, errC); err != nil {
+		t.Fatal(err)
+	}
+	if s.Reason() != ReasonRestart {
+		t.Fatalf("Reason() = %s, want %s", s.Reason(), ReasonRestart)
+	}
+	execLs := r.execListeners()
+	if len(execLs) != 1 || execLs[0].Addr().String() != l.Addr().String() {
+		t.Fatalf("listeners passed to Exec = %v, want the one on %s", execLs, l.Addr())
+	}
+
+	// The re-executed process serves TLS on the listener it inherits.
+	s, errC = serveTLS(newFakeRestarter(execLs...))
+	getTLS()
+	s.Stop()
+	if err := waitErr(t, errC); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRestartTCP4(t *testing.T) {
+	keepRestartEnv(t)
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "http://" + l.Addr().String() + "/"
+
+	// serve4 serves like a process started by a restart, on the listeners of r.
+	serve4 := func(r *fakeRestarter) (*Server, <-chan error) {
+		s := newTestServer()
+		s.Network = "tcp4"
+		s.Restarter = r
+		errC := make(chan error, 1)
+		go func() { errC <- s.ListenAndServe("127.0.0.1:0", &http.Server{Handler: okHandler}) }()
+		r.waitServing(t, errC)
+		return s, errC
+	}
+
+	r := newFakeRestarter(l)
+	s, errC := serve4(r)
+	c := &http.Client{Transport: &http.Transport{}}
+	get(t, c, url)
+	c.CloseIdleConnections()
+	s.Restart()
+	if err := waitErr(t, errC); err != nil {
+		t.Fatal(err)
+	}
+
+	// The listener passed on restart is still an IPv4 one.
+	execLs := r.execListeners()
+	if len(execLs) != 1 {
+		t.Fatalf("%d listeners are passed to Exec, want 1", len(execLs))
+	}
+	addr, ok := execLs[0].Addr().(*net.TCPAddr)
+	if !ok || addr.IP.To4() == nil || addr.String() != l.Addr().String() {
+		t.Fatalf("listener passed to Exec is on %v, want %s", execLs[0].Addr(), l.Addr())
+	}
+	s, errC = serve4(newFakeRestarter(execLs...))
+	if body := get(t, c, url); body != "ok" {
+		t.Errorf("body = %q, want %q", body, "ok")
+	}
+	c.CloseIdleConnections()
+	s.Stop()
+	if err := waitErr(t, errC); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSIGQUITAfterHandoff(t *testing.T) {
+	keepRestartEnv(t)
+	// The process is the parent re-executed on restart, which tells the child to drain when it serves.
+	t.Setenv("GOAGAIN_PID", "12345")
+	t.Setenv("GOAGAIN_PPID", strconv.Itoa(os.Getpid()))
+	defer func(n int) { restartCount = n }(restartCount)
+	restartCount = 1
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newFakeRestarter(l)
+	s := newTestServer()
+	s.Restarter = r
+	s.LameDuckDuration = time.Millisecond
+	var mu sync.Mutex
+	var phases []string
+	s.OnPhase = func(phase string) {
+		mu.Lock()
+		phases = append(phases, phase)
+		mu.Unlock()
+	}
+	errC := make(chan error, 1)
+	go func() { errC <- s.ListenAndServe("127.0.0.1:0", &http.Server{Handler: okHandler}) }()
+	r.waitServing(t, errC)
+
+	// The handoff is over, SIGQUIT from an operator is a shutdown.
+	r.signal(t, syscall.SIGQUIT)
+	if err := waitErr(t, errC); err != nil {
+		t.Fatal(err)
+	}
+	if hasHandoffPeer() {
+		t.Error("the child of the restart is not forgotten after the handoff")
+	}
+	if h := s.LastHandoff(); !h.Ready.IsZero() {
+		t.Errorf("shutdown is recorded as a handoff: %+v", h)
+	}
+	if s.Reason() != ReasonShutdown {
+		t.Errorf("Reason() = %s, want %s", s.Reason(), ReasonShutdown)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(phases) < 2 || phases[1] != PhaseLameDuck {
+		t.Errorf("phases = %q, want %q after %q", phases, PhaseLameDuck, PhaseStopAccepting)
+	}
+}
+
+// BenchmarkRestartLatency measures the longest time a client waits for a response while the server restarts,
+// with each strategy. Starting the new process is simulated with a delay, restartStartup.
+// Each request is sent on a new connection, so it is accepted during the restart.
+func BenchmarkRestartLatency(b *testing.B) {
+	b.Run("DoubleFork", func(b *testing.B) { benchmarkRestartLatency(b, DoubleFork) })
+	b.Run("ExecInPlace", func(b *testing.B) { benchmarkRestartLatency(b, ExecInPlace) })
+}
+
+const restartStartup = 50 * time.Millisecond
+
+// restartProcess is a server standing for a process of the restart benchmark.
+type restartProcess struct {
+	s    *Server
+	r    *fakeRestarter
+	errC <-chan error
+}
+
+func benchmarkRestartLatency(b *testing.B, strategy Strategy) {
+	keepRestartEnv(b)
+	for _, k := range envHandoffPID {
+		b.Setenv(k, os.Getenv(k))
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	url := "http://" + l.Addr().String() + "/"
+
+	// start starts a process serving on ls after restartStartup. ready is called when it serves.
+	next := make(chan restartProcess, 1)
+	var start func(ls []net.Listener, ready func())
+	start = func(ls []net.Listener, ready func()) {
+		r := newFakeRestarter(ls...)
+		r.onKill = ready
+		s := newTestServer()
+		s.Strategy = strategy
+		s.Restarter = r
+		switch strategy {
+		case DoubleFork:
+			// The child gets its own descriptors and tells the parent to drain when it serves.
+			// The parent is not re-executed, the child goes on serving instead.
+			r.forkExec = func(ls []net.Listener) error {
+				dups, err := dupListeners(ls)
+				if err != nil {
+					return err
+				}
+				go start(dups, func() { r.send(sigRestart) })
+				return nil
+			}
+			r.exec = func(ls []net.Listener) error {
+				closeListeners(ls)
+				return nil
+			}
+		case ExecInPlace:
+			// The process drains and starts again on the same descriptors.
+			r.exec = func(ls []net.Listener) error {
+				go start(ls, nil)
+				return nil
+			}
+		}
+		time.Sleep(restartStartup)
+		errC := make(chan error, 1)
+		next <- restartProcess{s, r, errC}
+		errC <- s.ListenAndServe("127.0.0.1:0", &http.Server{Handler: okHandler})
+	}
+	waitServing := func() restartProcess {
+		p := <-next
+		p.r.waitServing(b, p.errC)
+		return p
+	}
+	go start([]net.Listener{l}, nil)
+	p := waitServing()
+
+	var mu sync.Mutex
+	var max time.Duration
+	var failures int
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		c := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Millisecond):
+			}
+			begin := time.Now()
+			resp, err := c.Get(url)
+			if err == nil {
+				_, err = io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+			d := time.Since(begin)
+			mu.Lock()
+			if err != nil {
+				failures++
+			} else if d > max {
+				max = d
+			}
+			mu.Unlock()
+		}
+	}()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.s.Restart()
+		if err := waitErr(b, p.errC); err != nil {
+			b.Fatal(err)
+		}
+		p = waitServing()
+	}
+	b.StopTimer()
+	close(stop)
+	<-stopped
+	p.s.Stop()
+	if err := waitErr(b, p.errC); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportMetric(float64(max)/float64(time.Millisecond), "max-latency-ms")
+	b.ReportMetric(float64(failures), "failures")
+}
@@ -0,0 +1,174 @@
+package httpagain
+
+import (
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Signals configures which signals restart or shut down the server.
+//
+// Restart signals only start a restart. With the double-fork strategy the parent forks a child,
+// the child sends SIGUSR2 to the parent when it is ready and then the parent drains and re-executes itself.
+// The re-executed parent sends SIGQUIT to the child to shut it down.
+// Because of this handshake, SIGUSR2 after a fork and SIGQUIT are always handled
+// no matter what is configured here.
+type Signals struct {
+	// Restart signals start a graceful restart.
+	Restart []os.Signal
+
+	// Shutdown signals start a graceful shutdown.
+	Shutdown []os.Signal
+}
+
+// SetSignals sets the signals handled by the server started with ListenAndServe.
+func SetSignals(signals Signals) { defaultServer.Signals = &signals }
+
+func (s *Server) signals() Signals {
+	if s.Signals != nil {
+		return *s.Signals
+	}
+	return DefaultSignals
+}
+
+// waitSignal is like goagain.Wait but handles the signals configured for the server
+// and passes all listeners to the child.
+// It returns SIGUSR2 when the restart handshake is completed, or right away with ExecInPlace.
+// It stops waiting and returns 0 if the server is stopped.
+// peerServing tells whether sig is sent by the other process of the restart when it is serving.
+// Restart signals are ignored if ls are not restartable.
+func (s *Server) waitSignal(ls []net.Listener, restartable bool) (sig syscall.Signal, peerServing bool, err error) {
+	signals := s.signals()
+	notify := []os.Signal{sigRestart, syscall.SIGQUIT}
+	notify = append(notify, signals.Restart...)
+	notify = append(notify, signals.Shutdown...)
+
+	r := s.restarter()
+	ch := make(chan os.Signal, 2)
+	r.Notify(ch, notify...)
+	defer r.StopNotify(ch)
+
+	forked := false
+	var handoff <-chan time.Time // fires if the child is not ready in HandoffTimeout
+	defer atomic.StoreInt32(&s.handingOff, 0)
+
+	// The child is stopped if the server shuts down before it is ready,
+	// otherwise it would go on serving on the listeners unnoticed.
+	abortFork := func() {
+		s.logger().Printf("restart %d: shutting down, stopping child pid %d", RestartCount()+1, handoffPeer())
+		if err := r.Abort(); err != nil {
+			s.logger().Printf("cannot stop child: %s", err)
+		}
+	}
+	for {
+		select {
+		case sig := <-ch:
+			s.logger().Printf("received signal: %s", sig)
+			switch {
+			case sig == sigRestart && forked:
+				// The child is ready.
+				s.logger().Printf("restart %d: child pid %d is serving, draining", RestartCount()+1, handoffPeer())
+				return sigRestart, true, nil
+			case sig == syscall.SIGQUIT && !forked && RestartCount() > 0 && handoffPeer() != 0:
+				// The re-executed parent is ready.
+				s.logger().Printf("restart %d: parent pid %d is serving, draining", RestartCount(), handoffPeer())
+				if err := clearHandoffEnv(); err != nil {
+					s.logger().Printf("restart %d: cannot clear handoff: %s", RestartCount(), err)
+				}
+				return syscall.SIGQUIT, true, nil
+			case sig == syscall.SIGQUIT || hasSignal(signals.Shutdown, sig):
+				if forked {
+					abortFork()
+				}
+				return sig.(syscall.Signal), false, nil
+			case !hasSignal(signals.Restart, sig):
+				continue
+			}
+		case <-s.restartChan():
+			s.logger().Printf("restart is requested")
+		case <-handoff:
+			s.logger().Printf("child did not become ready in allowed period, restart is aborted")
+			if err := r.Abort(); err != nil {
+				s.logger().Printf("cannot stop child: %s", err)
+			}
+			forked, handoff = false, nil
+			atomic.StoreInt32(&s.handingOff, 0)
+			continue
+		case <-s.Stopping():
+			if forked {
+				abortFork()
+			}
+			return 0, false, nil
+		}
+
+		if !restartable {
+			s.logger().Printf("restart is not supported for listeners passed to Serve")
+			continue
+		}
+		if forked {
+			s.logger().Printf("restart is already in progress")
+			continue
+		}
+		if s.BeforeExec != nil {
+			if err := s.BeforeExec(); err != nil {
+				s.logger().Printf("restart is aborted: %s", err)
+				continue
+			}
+		}
+		if err := setRestartEnv(); err != nil {
+			s.logger().Printf("cannot fork child: %s", err)
+			continue
+		}
+		if err := checkExecEnv(s.ExecEnv); err != nil {
+			s.logger().Printf("cannot fork child: %s", err)
+			continue
+		}
+		if s.Strategy == ExecInPlace {
+			// Drain and re-execute without a child.
+			if err := clearHandoffEnv(); err != nil {
+				s.logger().Printf("cannot restart: %s", err)
+				continue
+			}
+			return sigRestart, false, nil
+		}
+		if err := r.ForkExec(ls); err != nil {
+			s.logger().Printf("cannot fork child: %s", err)
+			continue
+		}
+		forked = true
+		atomic.StoreInt32(&s.handingOff, 1)
+		s.logger().Printf("restart %d: forked child pid %d, waiting for it to serve", RestartCount()+1, handoffPeer())
+		if s.HandoffTimeout > 0 {
+			handoff = s.clock().After(s.HandoffTimeout)
+		}
+	}
+}
+
+// Restart starts a graceful restart as if a restart signal is received.
+// It does nothing if a restart is already requested.
+func (s *Server) Restart() {
+	select {
+	case s.restartChan() <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Server) restartChan() chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.restart == nil {
+		s.restart = make(chan struct{}, 1)
+	}
+	return s.restart
+}
+
+func hasSignal(signals []os.Signal, sig os.Signal) bool {
+	for _, s := range signals {
+		if s == sig {
+			return true
+		}
+	}
+	return false
+}
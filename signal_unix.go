@@ -0,0 +1,17 @@
+//go:build !windows
+
+package httpagain
+
+import (
+	"os"
+	"syscall"
+)
+
+// sigRestart is sent by the child to the parent when it is ready, see Signals.
+const sigRestart = syscall.SIGUSR2
+
+// DefaultSignals are used if Server.Signals is nil.
+var DefaultSignals = Signals{
+	Restart:  []os.Signal{syscall.SIGUSR2},
+	Shutdown: []os.Signal{syscall.SIGINT, syscall.SIGTERM},
+}
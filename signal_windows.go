@@ -0,0 +1,15 @@
+package httpagain
+
+import (
+	"os"
+	"syscall"
+)
+
+// sigRestart is never delivered on Windows, where restart is not supported.
+const sigRestart = syscall.Signal(-1)
+
+// DefaultSignals are used if Server.Signals is nil.
+// There are no restart signals on Windows.
+var DefaultSignals = Signals{
+	Shutdown: []os.Signal{os.Interrupt, syscall.SIGTERM},
+}
@@ -0,0 +1,66 @@
+package httpagain
+
+import (
+	"os"
+	"strconv"
+)
+
+// Strategy is the way a server restarts.
+type Strategy int
+
+const (
+	// DoubleFork starts a child process that serves while the process drains, then the process
+	// re-executes itself and the child exits once the re-executed process is serving.
+	// The PID of the process does not change, so a supervisor such as upstart, supervisord, runit
+	// or daemontools keeps tracking it. The child is a short-lived child of the supervised process
+	// and does not get the signals the supervisor sends to it.
+	DoubleFork Strategy = iota
+
+	// ExecInPlace drains and re-executes the process without starting another one.
+	// It suits supervisors that do not tolerate any other process, e.g. a runit run script that
+	// execs the server. The listeners stay open, so no connection is refused, but connections that
+	// arrive while the process drains and starts up wait in the accept queue until it serves again.
+	// HandoffTimeout does not apply.
+	ExecInPlace
+)
+
+// envHandoffPID has the PIDs of the processes to notify when the new process is serving.
+var envHandoffPID = []string{"GOAGAIN_PID", "GOAGAIN_PPID"}
+
+// clearHandoffEnv tells the re-executed process not to notify another process when it is serving,
+// because no other process is started with ExecInPlace. It also forgets the other process once the
+// handoff is over, so its signals are not expected anymore.
+func clearHandoffEnv() error {
+	for _, k := range envHandoffPID {
+		if err := os.Unsetenv(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handoffPeer returns the PID of the other process of the restart, like goagain.Kill finds it.
+// It is the child in the parent, or in the re-executed parent, and the parent in the child.
+// It returns 0 if there is no such process.
+func handoffPeer() int {
+	for _, k := range envHandoffPID {
+		if pid, err := strconv.Atoi(os.Getenv(k)); err == nil {
+			return pid
+		}
+	}
+	return 0
+}
+
+// isReexecutedParent tells whether the process is the parent re-executed after its child started serving,
+// as opposed to the child, which has only the PID of its parent.
+func isReexecutedParent() bool { return os.Getenv(envHandoffPID[0]) != "" }
+
+// hasHandoffPeer tells whether another process waits for this one to start serving.
+func hasHandoffPeer() bool {
+	for _, k := range envHandoffPID {
+		if os.Getenv(k) != "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package httpagain
+
+import (
+	"os"
+	"time"
+)
+
+// watchInterval is how often watched files are checked for changes.
+const watchInterval = time.Second
+
+// fileStat is the part of file info that changes when the file is written.
+type fileStat struct {
+	modTime time.Time
+	size    int64
+}
+
+// WatchFiles restarts the server when one of the files at paths changes, e.g. to reload configuration.
+// Files are checked every second. The restart starts after the files stop changing for a check,
+// so writing a file in several steps causes a single restart. BeforeExec is called before restarting
+// as it is for restart signals, so a broken configuration can abort the restart.
+// Watching stops when the server stops.
+func (s *Server) WatchFiles(paths ...string) error {
+	last, err := statFiles(paths)
+	if err != nil {
+		return err
+	}
+	go s.watchFiles(paths, last)
+	return nil
+}
+
+// WatchFiles restarts the server started with ListenAndServe when one of the files at paths changes.
+// See Server.WatchFiles.
+func WatchFiles(paths ...string) error { return defaultServer.WatchFiles(paths...) }
+
+func (s *Server) watchFiles(paths []string, last []fileStat) {
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+	changed := false
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.Stopping():
+			return
+		}
+		stats, err := statFiles(paths)
+		if err != nil {
+			// The file may be missing for a moment while it is replaced.
+			s.logger().Printf("cannot check watched files: %s", err)
+			continue
+		}
+		if !equalStats(stats, last) {
+			last = stats
+			changed = true
+			continue
+		}
+		if changed {
+			changed = false
+			s.logger().Printf("watched files are changed")
+			s.Restart()
+		}
+	}
+}
+
+func statFiles(paths []string) ([]fileStat, error) {
+	stats := make([]fileStat, len(paths))
+	for i, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		stats[i] = fileStat{fi.ModTime(), fi.Size()}
+	}
+	return stats, nil
+}
+
+func equalStats(a, b []fileStat) bool {
+	for i := range a {
+		if !a[i].modTime.Equal(b[i].modTime) || a[i].size != b[i].size {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,39 @@
+package httpagain
+
+import "os"
+
+// startWatchdog makes the process exit if draining does not finish in ShutdownDeadline.
+// On restart, the process is re-executed instead, so the new version takes over.
+// The returned function stops the watchdog.
+func (s *Server) startWatchdog(restart bool) (stop func()) {
+	if s.ShutdownDeadline <= 0 {
+		return func() {}
+	}
+	expired := s.clock().After(s.ShutdownDeadline)
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-expired:
+			s.forceExit(restart)
+		case <-stopped:
+		}
+	}()
+	return func() { close(stopped) }
+}
+
+func (s *Server) forceExit(restart bool) {
+	s.logger().Printf("draining did not finish in %s, %d requests are active and %d connections are open, forcing exit",
+		s.ShutdownDeadline, s.ActiveRequests(), s.ActiveConnections())
+	s.logCallSites()
+	s.dumpGoroutines()
+	// Reset the connections before they are closed by exiting, so clients do not take truncated responses as complete.
+	s.closeConns(false)
+	s.closeConns(true)
+	if restart {
+		s.enterPhase(PhaseExec)
+		if err := s.Exec(); err != nil {
+			s.logger().Printf("cannot re-execute: %s", err)
+		}
+	}
+	os.Exit(1)
+}